@@ -0,0 +1,221 @@
+package modulir
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Version of the cache file format. Bump this whenever the format changes in
+// a way that's incompatible with older versions, and old cache files will be
+// discarded instead of being misinterpreted.
+const fileCacheVersion = 2
+
+// The format of the cache file that's persisted to disk.
+type fileCacheData struct {
+	// Version is the version of the format that the cache was written with.
+	Version int `json:"version"`
+
+	// ChangeDetection is the change detection strategy in use when the cache
+	// was written. Records from one strategy can't be compared using
+	// another, so if it differs, the cache is considered stale.
+	ChangeDetection ChangeDetection `json:"change_detection"`
+
+	// Key is the Config.CacheKey in use when the cache was written. If it
+	// differs, the cache is considered stale.
+	Key string `json:"key"`
+
+	// TargetDir is the absolute path of the target directory that was built
+	// along with the cache. If it differs, the cache is considered stale.
+	TargetDir string `json:"target_dir"`
+
+	// Files maps paths to what was known about them at the end of the build
+	// that wrote the cache.
+	Files map[string]fileRecord `json:"files"`
+}
+
+// Loads the cache file configured on the context (if any) into its
+// fileModTimeCache so that files seen in a previous run aren't considered
+// changed by the first build.
+//
+// A cache that's corrupt, of the wrong version, or stale is logged and
+// discarded, falling back to a full build. It'll be overwritten the next
+// time a build succeeds.
+func loadFileCache(c *Context) {
+	if c.CacheFile == "" {
+		return
+	}
+
+	data, err := readFileCache(c.CacheFile, c.TargetDir, c.fileModTimeCache.detection,
+		c.CacheKey)
+	if err != nil {
+		c.Log.Warnf("Discarding cache file '%s': %v", c.CacheFile, err)
+		return
+	}
+
+	if data == nil {
+		c.Log.Debugf("No cache file at '%s'; doing a full build", c.CacheFile)
+		return
+	}
+
+	c.fileModTimeCache.mu.Lock()
+	c.fileModTimeCache.pathToModTimeMapPersisted = data.Files
+	c.fileModTimeCache.mu.Unlock()
+
+	c.Log.Infof("Loaded cache file '%s' with %v file(s)", c.CacheFile, len(data.Files))
+}
+
+// Reads and validates a cache file. Returns nil without an error if the file
+// doesn't exist.
+func readFileCache(path, targetDir string, detection ChangeDetection,
+	key string) (*fileCacheData, error) {
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading cache file")
+	}
+
+	var data fileCacheData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, errors.Wrap(err, "Cache file is corrupt")
+	}
+
+	if data.Version != fileCacheVersion {
+		return nil, fmt.Errorf("Cache file version is %v, but expected %v",
+			data.Version, fileCacheVersion)
+	}
+
+	if data.ChangeDetection != detection {
+		return nil, fmt.Errorf("Cache file was written with change detection '%s'",
+			data.ChangeDetection)
+	}
+
+	if data.Key != key {
+		return nil, fmt.Errorf("Cache file was written with key '%s'", data.Key)
+	}
+
+	absTargetDir, err := filepath.Abs(targetDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting absolute target directory")
+	}
+
+	if data.TargetDir != absTargetDir {
+		return nil, fmt.Errorf("Cache file was written for target directory '%s'",
+			data.TargetDir)
+	}
+
+	// If the target directory is gone or was emptied, everything that
+	// the cache says was built is gone too.
+	infos, err := ioutil.ReadDir(targetDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "Error reading target directory")
+	}
+	if len(infos) < 1 {
+		return nil, fmt.Errorf("Target directory '%s' is empty", targetDir)
+	}
+
+	if data.Files == nil {
+		data.Files = make(map[string]fileRecord)
+	}
+
+	return &data, nil
+}
+
+// Saves the context's fileModTimeCache to its configured cache file. The file
+// is written atomically so that a crash midway through never leaves a
+// partial cache behind.
+func saveFileCache(c *Context) error {
+	if c.CacheFile == "" {
+		return nil
+	}
+
+	absTargetDir, err := filepath.Abs(c.TargetDir)
+	if err != nil {
+		return errors.Wrap(err, "Error getting absolute target directory")
+	}
+
+	data := fileCacheData{
+		Version:         fileCacheVersion,
+		ChangeDetection: c.fileModTimeCache.detection,
+		Key:             c.CacheKey,
+		TargetDir:       absTargetDir,
+		Files:           c.fileModTimeCache.snapshot(),
+	}
+
+	raw, err := json.Marshal(&data)
+	if err != nil {
+		return errors.Wrap(err, "Error marshaling cache file")
+	}
+
+	if err := writeFileAtomically(c.CacheFile, raw); err != nil {
+		return errors.Wrap(err, "Error writing cache file")
+	}
+
+	c.Log.Debugf("Saved cache file '%s' with %v file(s)", c.CacheFile, len(data.Files))
+	return nil
+}
+
+// Returns a copy of every record in the cache including ones collected
+// during the current round that haven't been promoted yet.
+func (c *fileModTimeCache) snapshot() map[string]fileRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	records := make(map[string]fileRecord,
+		len(c.pathToModTimeMap)+len(c.pathToModTimeMapNew))
+	for path, record := range c.pathToModTimeMap {
+		records[path] = record
+	}
+	for path, record := range c.pathToModTimeMapNew {
+		records[path] = record
+	}
+	return records
+}
+
+// Writes data to a file by way of a temporary file that's renamed into place
+// so that a crash midway through never leaves a partial file behind. Creates
+// the file's directory if needed.
+func writeFileAtomically(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "Error creating directory")
+	}
+
+	tempFile, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "Error creating temporary file")
+	}
+
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return errors.Wrap(err, "Error writing temporary file")
+	}
+
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		os.Remove(tempFile.Name())
+		return errors.Wrap(err, "Error moving file into place")
+	}
+
+	return nil
+}
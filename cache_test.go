@@ -0,0 +1,133 @@
+package modulir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	assert.NoError(t, ioutil.WriteFile(source, []byte("source"), 0644))
+
+	targetDir := filepath.Join(dir, "public")
+	assert.NoError(t, os.MkdirAll(targetDir, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(targetDir, "index.html"), []byte("index"), 0644))
+
+	cacheFile := filepath.Join(dir, "cache", "modulir.json")
+
+	{
+		c := newCacheContext(cacheFile, targetDir)
+		loadFileCache(c)
+
+		assert.True(t, c.Changed(source))
+		assert.NoError(t, saveFileCache(c))
+	}
+
+	// A new context loading the cache sees the file as unchanged.
+	{
+		c := newCacheContext(cacheFile, targetDir)
+		loadFileCache(c)
+
+		assert.False(t, c.Changed(source))
+	}
+
+	// But picks up a modification.
+	{
+		future := time.Now().Add(10 * time.Second)
+		assert.NoError(t, os.Chtimes(source, future, future))
+
+		c := newCacheContext(cacheFile, targetDir)
+		loadFileCache(c)
+
+		assert.True(t, c.Changed(source))
+	}
+}
+
+func TestReadFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	targetDir := filepath.Join(dir, "public")
+	assert.NoError(t, os.MkdirAll(targetDir, 0755))
+
+	cacheFile := filepath.Join(dir, "modulir.json")
+
+	// A missing cache file is not an error.
+	{
+		data, err := readFileCache(cacheFile, targetDir, ChangeDetectionModTime, "")
+		assert.NoError(t, err)
+		assert.Nil(t, data)
+	}
+
+	// Empty target directory
+	{
+		c := newCacheContext(cacheFile, targetDir)
+		assert.NoError(t, saveFileCache(c))
+
+		_, err := readFileCache(cacheFile, targetDir, ChangeDetectionModTime, "")
+		assert.EqualError(t, err, "Target directory '"+targetDir+"' is empty")
+	}
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(targetDir, "index.html"), []byte("index"), 0644))
+
+	// Valid
+	{
+		data, err := readFileCache(cacheFile, targetDir, ChangeDetectionModTime, "")
+		assert.NoError(t, err)
+		assert.Equal(t, fileCacheVersion, data.Version)
+	}
+
+	// Different target directory
+	{
+		_, err := readFileCache(cacheFile, dir, ChangeDetectionModTime, "")
+		assert.EqualError(t, err, "Cache file was written for target directory '"+targetDir+"'")
+	}
+
+	// Different key
+	{
+		_, err := readFileCache(cacheFile, targetDir, ChangeDetectionModTime, "v2")
+		assert.EqualError(t, err, "Cache file was written with key ''")
+	}
+
+	// Different change detection
+	{
+		_, err := readFileCache(cacheFile, targetDir, ChangeDetectionContentHash, "")
+		assert.EqualError(t, err, "Cache file was written with change detection 'mod_time'")
+	}
+
+	// Corrupt
+	{
+		assert.NoError(t, ioutil.WriteFile(cacheFile, []byte("{not json"), 0644))
+
+		_, err := readFileCache(cacheFile, targetDir, ChangeDetectionModTime, "")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "Cache file is corrupt")
+	}
+
+	// Wrong version
+	{
+		assert.NoError(t, ioutil.WriteFile(cacheFile, []byte(`{"version":0}`), 0644))
+
+		_, err := readFileCache(cacheFile, targetDir, ChangeDetectionModTime, "")
+		assert.EqualError(t, err, "Cache file version is 0, but expected 2")
+	}
+}
+
+// Helper to create a new Modulir context with a cache file.
+func newCacheContext(cacheFile, targetDir string) *Context {
+	return NewContext(&Args{
+		CacheFile: cacheFile,
+		Log:       &Logger{Level: LevelInfo},
+		TargetDir: targetDir,
+	})
+}
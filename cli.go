@@ -0,0 +1,475 @@
+package modulir
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Public
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Main is an entry point that provides a command line interface for a site,
+// so that its program can be as simple as:
+//
+//	func main() {
+//	    modulir.Main(&modulir.Config{Websocket: true}, build)
+//	}
+//
+// It takes a subcommand as its first argument:
+//
+//	build   Build the site once
+//	clean   Remove the target directory and cache file
+//	loop    Build the site and rebuild it on changes while serving it
+//	serve   Serve the built site without building it
+//	stats   Build the site once and print statistics on its jobs
+//
+// Common properties of config can be overridden with flags (--concurrency,
+// --port, --progress, --target, --log-level, --log-format, and --color), or
+// with environment variables (MODULIR_CONCURRENCY, MODULIR_PORT,
+// MODULIR_PROGRESS, MODULIR_TARGET, MODULIR_LOG_LEVEL, MODULIR_LOG_FORMAT,
+// and MODULIR_COLOR). Flags take precedence over environment variables,
+// which take precedence over config.
+//
+// Main exits the process when it's done.
+func Main(config *Config, f func(*Context) []error) {
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	os.Exit(runCLI(ctx, config, f, os.Args, os.Getenv, os.Stdout, os.Stderr))
+}
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Prefix of environment variables that override configuration.
+const cliEnvPrefix = "MODULIR_"
+
+// A subcommand of the command line interface.
+type cliCommand struct {
+	Description string
+	Run         func(ctx context.Context, config *Config, f func(*Context) []error, stdout io.Writer) error
+}
+
+// The subcommands of the command line interface by name.
+var cliCommands = map[string]*cliCommand{
+	"build": {
+		Description: "Build the site once",
+		Run: func(ctx context.Context, config *Config, f func(*Context) []error, stdout io.Writer) error {
+			return NewBuilder(config, f).Run(ctx)
+		},
+	},
+	"clean": {
+		Description: "Remove the target directory and cache file",
+		Run: func(ctx context.Context, config *Config, f func(*Context) []error, stdout io.Writer) error {
+			return cleanTargetDir(config)
+		},
+	},
+	"loop": {
+		Description: "Build the site and rebuild it on changes while serving it",
+		Run: func(ctx context.Context, config *Config, f func(*Context) []error, stdout io.Writer) error {
+			return buildLoop(ctx, config, f)
+		},
+	},
+	"serve": {
+		Description: "Serve the built site without building it",
+		Run: func(ctx context.Context, config *Config, f func(*Context) []error, stdout io.Writer) error {
+			return serveTargetDir(ctx, config)
+		},
+	},
+	"stats": {
+		Description: "Build the site once and print statistics on its jobs",
+		Run: func(ctx context.Context, config *Config, f func(*Context) []error, stdout io.Writer) error {
+			c, err := NewBuilder(config, f).run(ctx)
+			if c != nil {
+				if report := c.status.lastReport(); report != nil {
+					printBuildStats(stdout, report)
+				}
+			}
+			return err
+		},
+	},
+}
+
+// Options that can be set from the command line and environment.
+type cliOptions struct {
+	Color       string
+	Concurrency int
+	LogFormat   string
+	LogLevel    string
+	Port        int
+	Progress    bool
+	Target      string
+}
+
+// Runs the command line interface with the given arguments (including the
+// program's name) and returns the status that the process should exit with.
+func runCLI(ctx context.Context, config *Config, f func(*Context) []error,
+	args []string, getenv func(string) string, stdout, stderr io.Writer) int {
+
+	config = initConfigDefaults(config)
+	program := filepath.Base(args[0])
+
+	options := newCLIOptions(config)
+	if err := options.applyEnv(getenv); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+
+	flags := options.flagSet(program)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		printCLIUsage(stderr, program, flags)
+	}
+
+	if len(args) < 2 {
+		printCLIUsage(stderr, program, flags)
+		return 2
+	}
+
+	name := args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		printCLIUsage(stdout, program, flags)
+		return 0
+	}
+
+	command, ok := cliCommands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "error: unknown command '%s'\n\n", name)
+		printCLIUsage(stderr, program, flags)
+		return 2
+	}
+
+	if err := flags.Parse(args[2:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	if err := options.apply(config); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 2
+	}
+
+	err := command.Run(ctx, config, f, stdout)
+	if err != nil {
+		// The errors of a failed build have already been logged.
+		if _, ok := err.(*BuildError); !ok {
+			fmt.Fprintf(stderr, "error: %v\n", err)
+		}
+		return 1
+	}
+
+	return 0
+}
+
+// Initializes options from a configuration.
+func newCLIOptions(config *Config) *cliOptions {
+	options := &cliOptions{
+		Color:       string(configLogColorMode(config)),
+		Concurrency: config.Concurrency,
+		LogFormat:   string(LogFormatText),
+		LogLevel:    "info",
+		Port:        config.Port,
+		Progress:    config.Progress,
+		Target:      config.TargetDir,
+	}
+
+	if logger, ok := config.Log.(*Logger); ok {
+		options.LogLevel = levelName(logger.Level)
+
+		if logger.Format != "" {
+			options.LogFormat = string(logger.Format)
+		}
+	}
+
+	return options
+}
+
+// Overrides options with any that are set in the environment.
+func (o *cliOptions) applyEnv(getenv func(string) string) error {
+	parseInt := func(name string, dest *int) error {
+		if val := getenv(cliEnvPrefix + name); val != "" {
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s%s: %s", cliEnvPrefix, name, val)
+			}
+			*dest = i
+		}
+		return nil
+	}
+
+	if err := parseInt("CONCURRENCY", &o.Concurrency); err != nil {
+		return err
+	}
+
+	if err := parseInt("PORT", &o.Port); err != nil {
+		return err
+	}
+
+	if val := getenv(cliEnvPrefix + "PROGRESS"); val != "" {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %sPROGRESS: %s", cliEnvPrefix, val)
+		}
+		o.Progress = b
+	}
+
+	if val := getenv(cliEnvPrefix + "COLOR"); val != "" {
+		o.Color = val
+	}
+
+	if val := getenv(cliEnvPrefix + "LOG_FORMAT"); val != "" {
+		o.LogFormat = val
+	}
+
+	if val := getenv(cliEnvPrefix + "LOG_LEVEL"); val != "" {
+		o.LogLevel = val
+	}
+
+	if val := getenv(cliEnvPrefix + "TARGET"); val != "" {
+		o.Target = val
+	}
+
+	return nil
+}
+
+// Applies options to a configuration.
+func (o *cliOptions) apply(config *Config) error {
+	colorMode := LogColorMode(o.Color)
+	if colorMode != LogColorAlways && colorMode != LogColorAuto && colorMode != LogColorNever {
+		return fmt.Errorf("Invalid color mode (should be one of %s, %s, or %s): %s",
+			LogColorAlways, LogColorAuto, LogColorNever, o.Color)
+	}
+
+	format := LogFormat(o.LogFormat)
+	if format != LogFormatJSON && format != LogFormatText {
+		return fmt.Errorf("Invalid log format (should be one of %s or %s): %s",
+			LogFormatJSON, LogFormatText, o.LogFormat)
+	}
+
+	level, err := parseLevel(o.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	// Custom loggers are left to manage their own format and level.
+	if logger, ok := config.Log.(*Logger); ok {
+		logger.Format = format
+		logger.Level = level
+	}
+
+	config.Concurrency = o.Concurrency
+	config.LogColorMode = colorMode
+	config.Port = o.Port
+	config.Progress = o.Progress
+	config.TargetDir = o.Target
+
+	return nil
+}
+
+// Produces a flag set for the options with their current values as
+// defaults.
+func (o *cliOptions) flagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	flags.StringVar(&o.Color, "color", o.Color,
+		"Whether to color log output: "+string(LogColorAlways)+", "+string(LogColorAuto)+", or "+string(LogColorNever))
+	flags.IntVar(&o.Concurrency, "concurrency", o.Concurrency,
+		"Number of jobs to run at once")
+	flags.StringVar(&o.LogFormat, "log-format", o.LogFormat,
+		"Format of log output: "+string(LogFormatJSON)+" or "+string(LogFormatText))
+	flags.StringVar(&o.LogLevel, "log-level", o.LogLevel,
+		"Minimum level of log messages: debug, info, warn, or error")
+	flags.IntVar(&o.Port, "port", o.Port,
+		"Port to serve the site on")
+	flags.BoolVar(&o.Progress, "progress", o.Progress,
+		"Show the progress of builds while they run")
+	flags.StringVar(&o.Target, "target", o.Target,
+		"Directory to build the site to")
+
+	return flags
+}
+
+// Removes the configured target directory, cache file, and outputs manifest
+// (see Config.PruneOutputs). It refuses to remove a target directory that
+// contains the source directory, which is almost certainly a
+// misconfiguration.
+func cleanTargetDir(config *Config) error {
+	target, err := filepath.Abs(config.TargetDir)
+	if err != nil {
+		return errors.Wrap(err, "Error resolving target directory")
+	}
+
+	source, err := filepath.Abs(config.SourceDir)
+	if err != nil {
+		return errors.Wrap(err, "Error resolving source directory")
+	}
+
+	if pathWithin(target, source) {
+		return fmt.Errorf("Refusing to clean target directory '%s' because it contains the source directory",
+			config.TargetDir)
+	}
+
+	config.Log.Infof("Removing target directory '%s'", config.TargetDir)
+	if err := os.RemoveAll(target); err != nil {
+		return errors.Wrap(err, "Error removing target directory")
+	}
+
+	if config.CacheFile != "" {
+		config.Log.Infof("Removing cache file '%s'", config.CacheFile)
+		if err := os.Remove(config.CacheFile); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Error removing cache file")
+		}
+	}
+
+	// A manifest left behind would list outputs that no longer exist.
+	if manifestPath, err := outputsManifestPath(config.CacheFile, config.TargetDir); err == nil {
+		if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "Error removing outputs manifest")
+		}
+	}
+
+	return nil
+}
+
+// Produces a context that's canceled when the process is interrupted or
+// terminated.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, unix.SIGTERM)
+
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+
+	return ctx, cancel
+}
+
+// Prints statistics on a build.
+func printBuildStats(w io.Writer, report *buildReport) {
+	result := "succeeded"
+	if !report.Success {
+		result = "failed"
+	}
+
+	fmt.Fprintf(w, "Build %s in %v\n", result, msDuration(report.DurationMs))
+	fmt.Fprintf(w, "%v job(s), %v did work in %v round(s), %v errored\n",
+		report.NumJobs, report.NumJobsExecuted, report.NumRounds, report.NumJobsErrored)
+
+	jobs := append([]*buildReportJob(nil), report.Jobs...)
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[j].DurationMs < jobs[i].DurationMs
+	})
+	if len(jobs) > maxDashboardSlowest {
+		jobs = jobs[:maxDashboardSlowest]
+	}
+
+	if len(jobs) < 1 {
+		return
+	}
+
+	fmt.Fprintf(w, "\nSlowest jobs:\n")
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, job := range jobs {
+		name := job.Name
+		if job.Reason != "" {
+			name += " (" + job.Reason + ")"
+		}
+		fmt.Fprintf(tw, "  %v\t%s\n", msDuration(job.DurationMs), name)
+	}
+	tw.Flush()
+}
+
+// Prints usage of the command line interface.
+func printCLIUsage(w io.Writer, program string, flags *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", program)
+
+	names := make([]string, 0, len(cliCommands))
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, cliCommands[name].Description)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nFlags:\n")
+	flags.SetOutput(w)
+	flags.PrintDefaults()
+
+	fmt.Fprintf(w, "\nFlags can also be set with environment variables like %sPORT.\n", cliEnvPrefix)
+}
+
+// Converts a duration in milliseconds from a report to a duration.
+func msDuration(ms float64) time.Duration {
+	return (time.Duration(ms * float64(time.Millisecond))).Truncate(100 * time.Microsecond)
+}
+
+// Serves the target directory over HTTP without building anything until ctx
+// is canceled.
+func serveTargetDir(ctx context.Context, config *Config) error {
+	c := initContext(config, nil)
+
+	// There are no builds to reload on, or to force from the dashboard.
+	c.Websocket = false
+	c.forceRebuild = nil
+
+	server, serveErrs, err := startServingTargetDirHTTP(ctx, c, sync.NewCond(&sync.Mutex{}))
+	if err != nil {
+		return err
+	}
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+	case serveErr = <-serveErrs:
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(timeoutCtx); err != nil && serveErr == nil {
+		serveErr = errors.Wrap(err, "Error shutting down HTTP server")
+	}
+
+	return serveErr
+}
@@ -0,0 +1,198 @@
+package modulir
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestRunCLI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	newConfig := func() *Config {
+		return &Config{
+			Log:       &Logger{Level: LevelWarn},
+			SourceDir: dir,
+			TargetDir: filepath.Join(dir, "public"),
+		}
+	}
+
+	noEnv := func(string) string { return "" }
+
+	run := func(config *Config, f func(*Context) []error, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		status := runCLI(context.Background(), config, f,
+			append([]string{"/bin/site"}, args...), noEnv, &stdout, &stderr)
+		return status, stdout.String(), stderr.String()
+	}
+
+	succeed := func(c *Context) []error {
+		c.AddJob("job", func() (bool, error) { return true, nil })
+		return c.Wait()
+	}
+
+	// No command
+	{
+		status, _, stderr := run(newConfig(), succeed)
+		assert.Equal(t, 2, status)
+		assert.Contains(t, stderr, "Usage: site <command> [flags]")
+		assert.Contains(t, stderr, "-concurrency")
+	}
+
+	// Unknown command
+	{
+		status, _, stderr := run(newConfig(), succeed, "deploy")
+		assert.Equal(t, 2, status)
+		assert.Contains(t, stderr, "error: unknown command 'deploy'")
+	}
+
+	// Bad flag value
+	{
+		status, _, stderr := run(newConfig(), succeed, "build", "--color=sometimes")
+		assert.Equal(t, 2, status)
+		assert.Contains(t, stderr, "Invalid color mode")
+	}
+
+	// Build
+	{
+		status, _, _ := run(newConfig(), succeed, "build")
+		assert.Equal(t, 0, status)
+		_, err := os.Stat(filepath.Join(dir, "public"))
+		assert.NoError(t, err)
+	}
+
+	// Failed build
+	{
+		status, _, stderr := run(newConfig(), func(c *Context) []error {
+			return []error{fmt.Errorf("error")}
+		}, "build")
+		assert.Equal(t, 1, status)
+
+		// Build errors are logged rather than printed again.
+		assert.NotContains(t, stderr, "error:")
+	}
+
+	// Stats
+	{
+		status, stdout, _ := run(newConfig(), succeed, "stats")
+		assert.Equal(t, 0, status)
+		assert.Contains(t, stdout, "Build succeeded in")
+		assert.Contains(t, stdout, "1 job(s), 1 did work in")
+		assert.Contains(t, stdout, "Slowest jobs:")
+	}
+
+	// Clean
+	{
+		status, _, _ := run(newConfig(), succeed, "clean")
+		assert.Equal(t, 0, status)
+		_, err := os.Stat(filepath.Join(dir, "public"))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestCLIOptions(t *testing.T) {
+	config := initConfigDefaults(&Config{
+		Concurrency: 5,
+		Port:        5000,
+		TargetDir:   "./public",
+	})
+
+	options := newCLIOptions(config)
+	assert.Equal(t, &cliOptions{
+		Color:       "auto",
+		Concurrency: 5,
+		LogFormat:   "text",
+		LogLevel:    "info",
+		Port:        5000,
+		Target:      "./public",
+	}, options)
+
+	env := map[string]string{
+		"MODULIR_CONCURRENCY": "20",
+		"MODULIR_LOG_FORMAT":  "json",
+		"MODULIR_LOG_LEVEL":   "debug",
+		"MODULIR_PORT":        "6000",
+		"MODULIR_PROGRESS":    "true",
+	}
+	assert.NoError(t, options.applyEnv(func(name string) string { return env[name] }))
+
+	// Flags take precedence over the environment.
+	flags := options.flagSet("site")
+	assert.NoError(t, flags.Parse([]string{"--port", "7000", "--color=never", "--target", "./dist"}))
+
+	assert.NoError(t, options.apply(config))
+	assert.Equal(t, 20, config.Concurrency)
+	assert.Equal(t, LogFormatJSON, config.Log.(*Logger).Format)
+	assert.Equal(t, LevelDebug, config.Log.(*Logger).Level)
+	assert.Equal(t, LogColorNever, config.LogColorMode)
+	assert.Equal(t, 7000, config.Port)
+	assert.True(t, config.Progress)
+	assert.Equal(t, "./dist", config.TargetDir)
+
+	// Bad values in the environment
+	{
+		err := newCLIOptions(config).applyEnv(func(name string) string {
+			if name == "MODULIR_PORT" {
+				return "abc"
+			}
+			return ""
+		})
+		assert.EqualError(t, err, "Invalid value for MODULIR_PORT: abc")
+	}
+}
+
+func TestCleanTargetDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A target directory containing the source directory is refused.
+	err = cleanTargetDir(&Config{
+		Log:       &Logger{Level: LevelWarn},
+		SourceDir: filepath.Join(dir, "content"),
+		TargetDir: dir,
+	})
+	assert.Error(t, err)
+	_, err = os.Stat(dir)
+	assert.NoError(t, err)
+
+	// The target directory, cache file, and outputs manifest are removed.
+	cacheFile := filepath.Join(dir, "cache.json")
+	assert.NoError(t, ioutil.WriteFile(cacheFile, []byte("{}"), 0644))
+	assert.NoError(t, ioutil.WriteFile(cacheFile+outputsManifestSuffix, []byte("{}"), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "public", "a"), 0755))
+
+	err = cleanTargetDir(&Config{
+		CacheFile: cacheFile,
+		Log:       &Logger{Level: LevelWarn},
+		SourceDir: filepath.Join(dir, "content"),
+		TargetDir: filepath.Join(dir, "public"),
+	})
+	assert.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "public"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(cacheFile)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(cacheFile + outputsManifestSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{LevelDebug, LevelError, LevelInfo, LevelWarn} {
+		parsed, err := parseLevel(levelName(level))
+		assert.NoError(t, err)
+		assert.Equal(t, level, parsed)
+	}
+
+	_, err := parseLevel("verbose")
+	assert.Error(t, err)
+}
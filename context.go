@@ -1,9 +1,15 @@
 package modulir
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -21,20 +27,77 @@ import (
 
 // Args are the set of arguments accepted by NewContext.
 type Args struct {
-	Concurrency int
-	Log         LoggerInterface
-	LogColor    bool
-	Pool        *Pool
-	Port        int
-	SourceDir   string
-	TargetDir   string
-	Watcher     *fsnotify.Watcher
-	Websocket   bool
+	AbortOnChange         bool
+	CacheFile             string
+	CacheKey              string
+	ChangeDetection       ChangeDetection
+	Concurrency           int
+	Log                   LoggerInterface
+	LogColor              bool
+	Pool                  *Pool
+	Port                  int
+	Progress              bool
+	PruneOutputs          bool
+	PruneOutputsAllowlist []string
+	PruneOutputsDryRun    bool
+	ReportPath            string
+	ServeContentTypes     map[string]string
+	ServeNotFoundPage     string
+	ServePrecompressed    bool
+	ServePrettyURLs       bool
+	ServeRedirectsFile    string
+	SourceDir             string
+	TargetDir             string
+	TracePath             string
+	Watcher               *fsnotify.Watcher
+	Websocket             bool
+	WebsocketURL          string
 }
 
+// ChangeDetection is a strategy used by Changed to decide whether a file has
+// changed.
+type ChangeDetection string
+
+// The possible strategies for change detection.
+const (
+	// ChangeDetectionModTime considers a file changed when its modification
+	// time moves forward. It's the cheapest strategy, but anything that
+	// touches a file (a Git checkout, a CI cache restore) triggers work, and
+	// changes within the granularity of the filesystem's timestamps are
+	// missed.
+	ChangeDetectionModTime ChangeDetection = "mod_time"
+
+	// ChangeDetectionSizeModTime considers a file changed when either its
+	// size or its modification time differs from when it was last seen,
+	// including when its modification time moves backwards.
+	ChangeDetectionSizeModTime ChangeDetection = "size_mod_time"
+
+	// ChangeDetectionContentHash considers a file changed only when a
+	// SHA-256 hash of its contents differs from when it was last seen. It's
+	// immune to touched files and coarse timestamps, but has to read every
+	// file that's checked, once per round.
+	ChangeDetectionContentHash ChangeDetection = "content_hash"
+)
+
 // Context contains useful state that can be used by a user-provided build
 // function.
 type Context struct {
+	// AbortOnChange causes a build that's in progress to be aborted by
+	// canceling its context when the watcher detects new changes.
+	AbortOnChange bool
+
+	// CacheFile is a path to a file where information on source files seen by
+	// Changed is persisted between runs. If empty, nothing is persisted.
+	CacheFile string
+
+	// CacheKey identifies anything that affects the build beyond its source
+	// files. A cache file written with a different key is discarded.
+	CacheKey string
+
+	// ChangeDetection is the strategy used by Changed to decide whether a
+	// file has changed.
+	ChangeDetection ChangeDetection
+
 	// Concurrency is the number of concurrent workers to run during the build
 	// step.
 	Concurrency int
@@ -55,8 +118,9 @@ type Context struct {
 	// Log is a logger that can be used to print information.
 	Log LoggerInterface
 
-	// LogColor specifies whether messages sent to Log should be color. You may
-	// want to set to true if you know output is going to a terminal.
+	// LogColor specifies whether messages sent to Log should be colored.
+	// When built from a Config, it's resolved from LogColorMode, taking into
+	// account whether output is going to a terminal.
 	LogColor bool
 
 	// Pool is the job pool used to build the static site.
@@ -66,6 +130,27 @@ type Context struct {
 	// HTTP.
 	Port int
 
+	// Progress enables a display of the progress of each build while it
+	// runs.
+	Progress bool
+
+	// PruneOutputs indicates that outputs recorded by previous builds that
+	// weren't recorded by the current one should be deleted from TargetDir
+	// at the end of a successful full build.
+	PruneOutputs bool
+
+	// PruneOutputsAllowlist is a set of patterns matching paths relative to
+	// TargetDir that should never be pruned.
+	PruneOutputsAllowlist []string
+
+	// PruneOutputsDryRun causes orphaned outputs to be logged instead of
+	// deleted.
+	PruneOutputsDryRun bool
+
+	// ReportPath is a path to which a JSON report is written after each
+	// build. Left empty, no report is written.
+	ReportPath string
+
 	// QuickPaths are a set of paths for which Changed will return true when
 	// the context is in "quick rebuild mode". During this time all the normal
 	// file system checks that Changed makes will be bypassed to enable a
@@ -76,6 +161,27 @@ type Context struct {
 	// Make sure to unset it after your build run is finished.
 	QuickPaths map[string]struct{}
 
+	// ServeContentTypes maps patterns of paths relative to TargetDir to the
+	// content types that the development server serves them with.
+	ServeContentTypes map[string]string
+
+	// ServeNotFoundPage is a path relative to TargetDir of a page that the
+	// development server serves with a 404 status for paths it can't find.
+	ServeNotFoundPage string
+
+	// ServePrecompressed causes the development server to serve
+	// precompressed siblings of files (".br" and ".gz") to clients that
+	// accept them.
+	ServePrecompressed bool
+
+	// ServePrettyURLs causes the development server to serve paths like
+	// "/about" from "about.html".
+	ServePrettyURLs bool
+
+	// ServeRedirectsFile is a path to a file of redirect rules in the style
+	// of Netlify's `_redirects` that the development server applies.
+	ServeRedirectsFile string
+
 	// SourceDir is the directory containing source files.
 	SourceDir string
 
@@ -88,6 +194,10 @@ type Context struct {
 	// TargetDir is the directory where the site will be built to.
 	TargetDir string
 
+	// TracePath is a path to which a timeline of each build is written in
+	// the Chrome Trace Event format. Left empty, no trace is written.
+	TracePath string
+
 	// Watcher is a file system watcher that picks up changes to source files
 	// and restarts the build loop.
 	Watcher *fsnotify.Watcher
@@ -98,43 +208,119 @@ type Context struct {
 	// Defaults to false.
 	Websocket bool
 
+	// WebsocketURL is an explicit URL that pages should connect to for the
+	// websocket. Left empty, it's derived by the websocket script.
+	WebsocketURL string
+
+	// buildCtx is the context of the current build, which the pool's
+	// context is derived from when the build is reset so that canceling it
+	// cancels the build even if it happens before the reset. It's set by the
+	// build loop for each build, and nil means that builds can only be
+	// canceled through the pool.
+	buildCtx context.Context
+
 	// Helper for producing rich colors and styles to the log.
 	colorizer *colorizer
 
 	// fileModTimeCache remembers the last modified times of files.
 	fileModTimeCache *fileModTimeCache
 
+	// forceRebuild receives requests for a forced full rebuild, like from
+	// the dashboard. It's buffered so that one request can be pending. It's
+	// nil when there's no build loop to read it, like when only serving.
+	forceRebuild chan struct{}
+
+	// outputs is the set of outputs recorded during the current build,
+	// relative to TargetDir.
+	outputs map[string]struct{}
+
+	// outputsMu synchronizes concurrent access to outputs and
+	// outputsWritten.
+	outputsMu sync.Mutex
+
+	// outputsWritten is the subset of outputs that were actually written
+	// during the current build, relative to TargetDir.
+	outputsWritten map[string]struct{}
+
+	// progress reports on the progress of builds if Progress is enabled.
+	progress *progressReporter
+
+	// status tracks the state of the build loop for the dashboard.
+	status *buildStatus
+
+	// unchangedSeen is set to 1 once Changed reports a file as unchanged
+	// during the current build, meaning that work may have been skipped
+	// without recording its outputs. It's accessed atomically because
+	// Changed is called concurrently by jobs.
+	unchangedSeen int32
+
 	// watchedPaths are the set of paths that we're currently watching. This
 	// information is tracked internally by fsnotify as well, but we track it here
 	// as well to help with debugging (for "too many open files" problems and the
 	// like).
 	watchedPaths map[string]struct{}
 
-	// watchedPathsMu synchronizes concurrent access to watchedPaths.
+	// watchedPathsMu synchronizes concurrent access to watchedPaths and
+	// watchTrees.
 	watchedPathsMu sync.RWMutex
+
+	// watchTrees are the roots of trees registered with WatchTree mapped to
+	// their filters.
+	watchTrees map[string]func(string) bool
 }
 
 // NewContext initializes and returns a new Context.
 func NewContext(args *Args) *Context {
 	c := &Context{
-		Concurrency: args.Concurrency,
-		FirstRun:    true,
-		Log:         args.Log,
-		LogColor:    args.LogColor,
-		Pool:        args.Pool,
-		Port:        args.Port,
-		SourceDir:   args.SourceDir,
-		Stats:       &Stats{},
-		TargetDir:   args.TargetDir,
-		Watcher:     args.Watcher,
-		Websocket:   args.Websocket,
+		AbortOnChange:         args.AbortOnChange,
+		CacheFile:             args.CacheFile,
+		CacheKey:              args.CacheKey,
+		ChangeDetection:       args.ChangeDetection,
+		Concurrency:           args.Concurrency,
+		FirstRun:              true,
+		Log:                   args.Log,
+		LogColor:              args.LogColor,
+		Pool:                  args.Pool,
+		Port:                  args.Port,
+		Progress:              args.Progress,
+		PruneOutputs:          args.PruneOutputs,
+		PruneOutputsAllowlist: args.PruneOutputsAllowlist,
+		PruneOutputsDryRun:    args.PruneOutputsDryRun,
+		ReportPath:            args.ReportPath,
+		ServeContentTypes:     args.ServeContentTypes,
+		ServeNotFoundPage:     args.ServeNotFoundPage,
+		ServePrecompressed:    args.ServePrecompressed,
+		ServePrettyURLs:       args.ServePrettyURLs,
+		ServeRedirectsFile:    args.ServeRedirectsFile,
+		SourceDir:             args.SourceDir,
+		Stats:                 &Stats{},
+		TargetDir:             args.TargetDir,
+		TracePath:             args.TracePath,
+		Watcher:               args.Watcher,
+		Websocket:             args.Websocket,
+		WebsocketURL:          args.WebsocketURL,
 
 		colorizer:        &colorizer{LogColor: args.LogColor},
-		fileModTimeCache: newFileModTimeCache(args.Log),
+		fileModTimeCache: newFileModTimeCache(args.Log, args.ChangeDetection),
+		forceRebuild:     make(chan struct{}, 1),
+		outputs:          make(map[string]struct{}),
+		outputsWritten:   make(map[string]struct{}),
+		status:           &buildStatus{},
 		watchedPaths:     make(map[string]struct{}),
+		watchTrees:       make(map[string]func(string) bool),
+	}
+
+	// Messages from the pool and the build need to go through the progress
+	// reporter so that they don't get mixed into its display.
+	if args.Progress && args.Pool != nil {
+		c.progress = newProgressReporter(args.Log, args.Pool, os.Stderr)
+		c.Log = c.progress.wrapLogger(args.Log)
+		c.fileModTimeCache.log = c.Log
+		args.Pool.log = c.Log
 	}
 
 	if args.Pool != nil {
+		args.Pool.changed = c.changed
 		args.Pool.colorizer = c.colorizer
 		c.Jobs = args.Pool.Jobs
 	}
@@ -143,8 +329,37 @@ func NewContext(args *Args) *Context {
 }
 
 // AddJob is a shortcut for adding a new job to the Jobs channel.
-func (c *Context) AddJob(name string, f func() (bool, error)) {
-	c.Jobs <- NewJob(name, f)
+//
+// The job won't be run until all the given dependencies have finished
+// successfully, and it's skipped if any of them fail. Dependencies are either
+// *Job handles as returned by AddJob or a JobName referring to a job that
+// will be added in the same round. The pool starts each job as soon as its
+// dependencies are met, so there's no need to separate them with a call to
+// Wait.
+func (c *Context) AddJob(name string, f func() (bool, error), deps ...Dependency) *Job {
+	job := NewJob(name, f)
+	job.DependsOn = deps
+	c.Jobs <- job
+	return job
+}
+
+// AddJobWithOptions is like AddJob, but takes a set of options to configure
+// the job with.
+func (c *Context) AddJobWithOptions(name string, f func() (bool, error), opts *JobOptions) *Job {
+	job := NewJob(name, f)
+	opts.apply(job)
+	c.Jobs <- job
+	return job
+}
+
+// AddJobWithContext is like AddJobWithOptions, but for a job function that
+// takes a context. The context is canceled if the job exceeds its timeout or
+// if the build is canceled, like on shutdown. Options may be nil.
+func (c *Context) AddJobWithContext(name string, f func(ctx context.Context) (bool, error), opts *JobOptions) *Job {
+	job := NewJobWithContext(name, f)
+	opts.apply(job)
+	c.Jobs <- job
+	return job
 }
 
 // AllowError is a helper that's useful for when an error coming back from a
@@ -156,61 +371,23 @@ func (c *Context) AllowError(executed bool, err error) bool {
 	return executed
 }
 
-// Changed returns whether the target path's modified time has changed since
-// the last time it was checked. It also saves the last modified time for
-// future checks.
+// Changed returns whether the target path has changed since the last time it
+// was checked according to the context's ChangeDetection strategy. It also
+// saves the file's current state for future checks.
 //
 // This function is very hot in that it gets checked many times, and probably
 // many times for every single job in a build loop. It needs to be optimized
 // fairly carefully for both speed and lack of contention when running
 // concurrently with other jobs.
 func (c *Context) Changed(path string) bool {
-	// Always return immediately if the context has been forced.
-	if c.Forced {
-		return true
-	}
-
-	// Make sure we're always operating against a normalized path.
-	//
-	// Note that fsnotify sends us cleaned paths which are what gets added to
-	// QuickPaths below, so cleaning here ensures that we're always comparing
-	// against the right thing.
-	path = filepath.Clean(path)
-
-	// Short circuit quickly if the context is in "quick rebuild mode".
-	if c.QuickPaths != nil {
-		_, ok := c.QuickPaths[path]
-		return ok
-	}
-
-	fileInfo, err := os.Stat(path)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			c.Log.Errorf("Path passed to Changed doesn't exist: %s", path)
-		}
-		return true
-	}
-
-	changed, ok := c.fileModTimeCache.isFileUpdated(fileInfo, path)
-
-	// If we got ok back, then we know the file was in the cache and also
-	// therefore would've been already watched. Return as early as possible.
-	if ok {
-		return changed
-	}
+	changed := c.changed(path)
 
-	if c.Watcher != nil {
-		err := c.addWatched(fileInfo, path)
-		if err != nil {
-			// Unfortunately the number shown here is misleading because
-			// fsnotify may have recursively added a bunch of file watches
-			// under a directory.
-			c.Log.Errorf("Error watching source: %v (num watches is %v)",
-				err, len(c.watchedPaths))
-		}
+	// Whatever the caller skips because of this won't record its outputs.
+	if !changed {
+		atomic.StoreInt32(&c.unchangedSeen, 1)
 	}
 
-	return true
+	return changed
 }
 
 // ChangedAny is the same as Changed except it returns true if any of the given
@@ -230,12 +407,67 @@ func (c *Context) ChangedAny(paths ...string) bool {
 	return changed
 }
 
+// RecordOutput records the given paths as outputs of the current build. It
+// should be called for any file in TargetDir that a job deliberately left in
+// place because it was already up to date. Files that were written should be
+// recorded with RecordWrittenOutput instead. Outputs of previous builds that
+// aren't recorded again are considered orphans when pruning with
+// PruneOutputs.
+//
+// Paths outside of TargetDir are ignored. Outputs declared on jobs with
+// Job.Outputs are recorded automatically, as are files written by helpers in
+// modules like mfile.
+func (c *Context) RecordOutput(paths ...string) {
+	c.outputsMu.Lock()
+	defer c.outputsMu.Unlock()
+
+	for _, path := range paths {
+		if rel, ok := relativeOutputPath(c.TargetDir, path); ok {
+			c.outputs[rel] = struct{}{}
+		}
+	}
+}
+
+// RecordWrittenOutput is like RecordOutput, but for files that were actually
+// written by the current build. Along with being protected from pruning,
+// they're sent to pages connected to the development server's websocket so
+// that changes can be applied in place (like swapping a stylesheet) instead
+// of reloading the page. That only happens when every job that did work in
+// the build declared its Job.Outputs, since otherwise there's no telling
+// what else was written, and pages are reloaded instead.
+func (c *Context) RecordWrittenOutput(paths ...string) {
+	c.outputsMu.Lock()
+	defer c.outputsMu.Unlock()
+
+	for _, path := range paths {
+		if rel, ok := relativeOutputPath(c.TargetDir, path); ok {
+			c.outputs[rel] = struct{}{}
+			c.outputsWritten[rel] = struct{}{}
+		}
+	}
+}
+
 // ResetBuild signals to the Context to do the bookkeeping it needs to do for
 // the next build round.
 func (c *Context) ResetBuild() {
 	c.Log.Debugf("Context ResetBuild()")
 	c.Stats.Reset()
 	c.fileModTimeCache.promote()
+
+	if c.Pool != nil {
+		parent := c.buildCtx
+		if parent == nil {
+			parent = context.Background()
+		}
+		c.Pool.resetCancel(parent)
+	}
+
+	c.outputsMu.Lock()
+	c.outputs = make(map[string]struct{})
+	c.outputsWritten = make(map[string]struct{})
+	c.outputsMu.Unlock()
+
+	atomic.StoreInt32(&c.unchangedSeen, 0)
 }
 
 // StartRound starts a new round for the context, also starting it on its
@@ -247,6 +479,7 @@ func (c *Context) StartRound() {
 	roundNum := c.Stats.NumRounds
 
 	c.Stats.NumRounds++
+	c.Stats.RoundStarts = append(c.Stats.RoundStarts, time.Now())
 
 	// Then start the pool again, which also has the side effect of
 	// reinitializing anything that needs to be reinitialized.
@@ -277,14 +510,21 @@ func (c *Context) Wait() []error {
 	// Wait for work to finish.
 	c.Pool.Wait()
 
+	c.Stats.RoundEnds = append(c.Stats.RoundEnds, time.Now())
+
 	// Note use of append even though we always expect the current set to be
 	// empty so that the slice is duplicated and not affected by its source
 	// being reset by `StartRound` below.
+	c.Stats.JobsAll = append(c.Stats.JobsAll, c.Pool.JobsAll...)
 	c.Stats.JobsErrored = append(c.Stats.JobsErrored, c.Pool.JobsErrored...)
 
 	c.Stats.JobsExecuted = append(c.Stats.JobsExecuted, c.Pool.JobsExecuted...)
+	c.Stats.JobsRetried = append(c.Stats.JobsRetried, c.Pool.JobsRetried...)
+	c.Stats.JobsTimedOut = append(c.Stats.JobsTimedOut, c.Pool.JobsTimedOut...)
 	c.Stats.NumJobs += len(c.Pool.JobsAll)
 
+	c.recordJobOutputs(c.Pool.JobsAll)
+
 	c.StartRound()
 
 	if c.Stats.JobsErrored == nil {
@@ -301,6 +541,140 @@ func (c *Context) Wait() []error {
 	return errors
 }
 
+// WatchTree registers dir as the root of a tree of directories to watch for
+// changes. Every directory under it is watched, including ones that are
+// created later, so that new files trigger a rebuild without ever having been
+// passed to Changed. Watches on directories that are removed are cleaned up.
+//
+// If filter is non-nil, only paths for which it returns true are considered.
+// A directory that's filtered out isn't watched and neither is anything
+// under it, and changes to files that are filtered out don't trigger a
+// rebuild.
+//
+// It's safe to call on every build. Trees that are already registered are
+// skipped. It does nothing if the context doesn't have a Watcher.
+func (c *Context) WatchTree(dir string, filter func(path string) bool) error {
+	if c.Watcher == nil {
+		return nil
+	}
+
+	dir = filepath.Clean(dir)
+
+	c.watchedPathsMu.Lock()
+	_, ok := c.watchTrees[dir]
+	if !ok {
+		c.watchTrees[dir] = filter
+	}
+	c.watchedPathsMu.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	return c.addWatchedTree(dir, filter)
+}
+
+// Implements Changed without noting that work may be skipped, for checks
+// made on behalf of jobs that record their outputs either way.
+func (c *Context) changed(path string) bool {
+	// Always return immediately if the context has been forced.
+	if c.Forced {
+		return true
+	}
+
+	// Make sure we're always operating against a normalized path.
+	//
+	// Note that fsnotify sends us cleaned paths which are what gets added to
+	// QuickPaths below, so cleaning here ensures that we're always comparing
+	// against the right thing.
+	path = filepath.Clean(path)
+
+	// Short circuit quickly if the context is in "quick rebuild mode".
+	if c.QuickPaths != nil {
+		_, ok := c.QuickPaths[path]
+		return ok
+	}
+
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.Log.Errorf("Path passed to Changed doesn't exist: %s", path)
+		}
+		return true
+	}
+
+	changed, ok := c.fileModTimeCache.isFileUpdated(fileInfo, path)
+
+	// If we got ok back, then we know the file was in the cache and also
+	// therefore would've been already watched. Return as early as possible.
+	if ok {
+		return changed
+	}
+
+	if c.Watcher != nil {
+		err := c.addWatched(fileInfo, path)
+		if err != nil {
+			// Unfortunately the number shown here is misleading because
+			// fsnotify may have recursively added a bunch of file watches
+			// under a directory.
+			c.Log.Errorf("Error watching source: %v (num watches is %v)",
+				err, len(c.watchedPaths))
+		}
+	}
+
+	// Usually true, but may be false if the file was recorded as unchanged in
+	// a cache file loaded from a previous run.
+	return changed
+}
+
+// Returns whether the build that just finished, made up of the given jobs,
+// did all of its work rather than skipping some because it was up to date.
+// Only then is every output known to have been recorded, which is what
+// pruning needs to find orphans.
+func (c *Context) fullBuild(jobs []*Job) bool {
+	if atomic.LoadInt32(&c.unchangedSeen) != 0 {
+		return false
+	}
+
+	// Jobs that were skipped still record the outputs that they declared.
+	for _, job := range jobs {
+		if !job.Executed && len(job.Outputs) < 1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Records the declared outputs of the given jobs, whether or not they ran.
+// Only those of jobs that executed are considered written.
+func (c *Context) recordJobOutputs(jobs []*Job) {
+	for _, job := range jobs {
+		if job.Executed {
+			c.RecordWrittenOutput(job.Outputs...)
+		} else {
+			c.RecordOutput(job.Outputs...)
+		}
+	}
+}
+
+// Returns a copy of the set of outputs recorded during the current build,
+// which is what pruning keeps.
+func (c *Context) recordedOutputs() map[string]struct{} {
+	c.outputsMu.Lock()
+	defer c.outputsMu.Unlock()
+
+	return copyKeys(c.outputs)
+}
+
+// Returns a copy of the set of outputs written during the current build.
+func (c *Context) writtenOutputs() map[string]struct{} {
+	c.outputsMu.Lock()
+	defer c.outputsMu.Unlock()
+
+	return copyKeys(c.outputsWritten)
+}
+
 func (c *Context) addWatched(fileInfo os.FileInfo, absolutePath string) error {
 	// Watch the parent directory unless the file is a directory itself. This
 	// will hopefully mean fewer individual entries in the notifier.
@@ -308,6 +682,11 @@ func (c *Context) addWatched(fileInfo os.FileInfo, absolutePath string) error {
 		absolutePath = filepath.Dir(absolutePath)
 	}
 
+	return c.addWatchedDir(absolutePath)
+}
+
+// Adds a watch on a directory if there isn't one already.
+func (c *Context) addWatchedDir(absolutePath string) error {
 	absolutePath = filepath.Clean(absolutePath)
 
 	c.watchedPathsMu.RLock()
@@ -329,8 +708,170 @@ func (c *Context) addWatched(fileInfo os.FileInfo, absolutePath string) error {
 	return nil
 }
 
+// Watches dir and every directory under it that passes filter.
+func (c *Context) addWatchedTree(dir string, filter func(path string) bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Directories can disappear between being listed and walked.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if path != dir && filter != nil && !filter(path) {
+			return filepath.SkipDir
+		}
+
+		return c.addWatchedDir(path)
+	})
+}
+
+// Returns the root and filter of the watch tree containing path, if any. When
+// trees are nested, the innermost one wins.
+func (c *Context) findWatchTree(path string) (string, func(string) bool, bool) {
+	c.watchedPathsMu.RLock()
+	defer c.watchedPathsMu.RUnlock()
+
+	var root string
+	var filter func(string) bool
+	var ok bool
+
+	for dir, dirFilter := range c.watchTrees {
+		if !pathWithin(dir, path) {
+			continue
+		}
+
+		if !ok || len(dir) > len(root) {
+			root, filter, ok = dir, dirFilter, true
+		}
+	}
+
+	return root, filter, ok
+}
+
+// Removes watches on a path that was removed or renamed and on everything
+// under it.
+func (c *Context) removeWatchedTree(path string) {
+	c.watchedPathsMu.Lock()
+	defer c.watchedPathsMu.Unlock()
+
+	for watchedPath := range c.watchedPaths {
+		if !pathWithin(path, watchedPath) {
+			continue
+		}
+
+		// fsnotify drops watches on directories that are removed by itself,
+		// so an error here is expected and uninteresting.
+		_ = c.Watcher.Remove(watchedPath)
+
+		delete(c.watchedPaths, watchedPath)
+	}
+}
+
+// Keeps watches up to date with an event from the watcher. A directory
+// created in a watch tree is watched along with anything already in it, and
+// watches on a removed or renamed directory are cleaned up. (A renamed
+// directory is watched again when the event for its new name comes in.)
+func (c *Context) updateWatched(event fsnotify.Event) {
+	if c.Watcher == nil {
+		return
+	}
+
+	path := filepath.Clean(event.Name)
+
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		c.removeWatchedTree(path)
+		return
+	}
+
+	if event.Op&fsnotify.Create == 0 {
+		return
+	}
+
+	_, filter, ok := c.findWatchTree(path)
+	if !ok || (filter != nil && !filter(path)) {
+		return
+	}
+
+	fileInfo, err := os.Stat(path)
+	if err != nil || !fileInfo.IsDir() {
+		return
+	}
+
+	if err := c.addWatchedTree(path, filter); err != nil {
+		c.Log.Errorf("Error watching new directory: %v (num watches is %v)",
+			err, c.numWatched())
+	}
+}
+
+// Returns whether a change to path should be ignored because it's in a watch
+// tree whose filter excludes it.
+func (c *Context) watchTreeExcludes(path string) bool {
+	_, filter, ok := c.findWatchTree(filepath.Clean(path))
+	return ok && filter != nil && !filter(filepath.Clean(path))
+}
+
+// Returns the number of paths being watched.
+func (c *Context) numWatched() int {
+	c.watchedPathsMu.RLock()
+	defer c.watchedPathsMu.RUnlock()
+
+	return len(c.watchedPaths)
+}
+
+// JobOptions are options for a job added with AddJobWithOptions.
+type JobOptions struct {
+	// Class is the name of the resource class that the job belongs to. See
+	// Job.Class and Config.ResourceClasses.
+	Class string
+
+	// DependsOn is a set of jobs that must finish successfully before this
+	// one is run. See Job.DependsOn.
+	DependsOn []Dependency
+
+	// Inputs are paths to files that the job reads. Along with Outputs,
+	// they're used to skip the job when it's up to date. See Job.Inputs.
+	Inputs []string
+
+	// Outputs are paths to files that the job writes. See Job.Outputs.
+	Outputs []string
+
+	// Priority decides the order in which ready jobs are run, with higher
+	// priorities first. See Job.Priority.
+	Priority int
+
+	// Retry is a policy for retrying the job if it fails. See Job.Retry.
+	Retry *RetryPolicy
+
+	// Timeout is a hard timeout for the job. See Job.Timeout.
+	Timeout time.Duration
+}
+
+// Applies the options to the given job. Safe to call on nil options.
+func (o *JobOptions) apply(job *Job) {
+	if o == nil {
+		return
+	}
+
+	job.Class = o.Class
+	job.DependsOn = o.DependsOn
+	job.Inputs = o.Inputs
+	job.Outputs = o.Outputs
+	job.Priority = o.Priority
+	job.Retry = o.Retry
+	job.Timeout = o.Timeout
+}
+
 // Stats tracks various statistics about the build process.
 type Stats struct {
+	// JobsAll is a slice of all the jobs that were run across all runs.
+	JobsAll []*Job
+
 	// JobsErrored is a slice of jobs that errored on the last run.
 	//
 	// Differs from JobsExecuted somewhat in that only one run of errors are
@@ -341,6 +882,14 @@ type Stats struct {
 	// JobsExecuted is a slice of jobs that were executed across all runs.
 	JobsExecuted []*Job
 
+	// JobsRetried is a slice of jobs that were retried at least once across
+	// all runs.
+	JobsRetried []*Job
+
+	// JobsTimedOut is a slice of jobs that exceeded their hard timeout
+	// across all runs. They're also included in JobsErrored.
+	JobsTimedOut []*Job
+
 	// LoopDuration is the total amount of time spent in the user's build loop
 	// enqueuing jobs. Jobs may be running in the background during this time,
 	// but all the time spent waiting for jobs to finish is excluded.
@@ -354,6 +903,14 @@ type Stats struct {
 	// result of jobs from other rounds.
 	NumRounds int
 
+	// RoundEnds are the times at which Wait finished waiting on the jobs of
+	// each round, indexed by round number.
+	RoundEnds []time.Time
+
+	// RoundStarts are the times at which each round started, indexed by
+	// round number.
+	RoundStarts []time.Time
+
 	// Start is the start time of the build loop.
 	Start time.Time
 
@@ -364,11 +921,16 @@ type Stats struct {
 
 // Reset resets statistics.
 func (s *Stats) Reset() {
+	s.JobsAll = nil
 	s.JobsErrored = nil
 	s.JobsExecuted = nil
+	s.JobsRetried = nil
+	s.JobsTimedOut = nil
 	s.LoopDuration = time.Duration(0)
 	s.NumJobs = 0
 	s.NumRounds = 0
+	s.RoundEnds = nil
+	s.RoundStarts = nil
 	s.Start = time.Now()
 	s.lastLoopStart = time.Now()
 }
@@ -386,43 +948,139 @@ func (s *Stats) Reset() {
 // FileModTimeCache tracks the last modified time of files seen so a
 // determination can be made as to whether they need to be recompiled.
 type fileModTimeCache struct {
+	detection           ChangeDetection
 	log                 LoggerInterface
 	mu                  sync.Mutex
-	pathToModTimeMap    map[string]time.Time
-	pathToModTimeMapNew map[string]time.Time
+	pathToModTimeMap    map[string]fileRecord
+	pathToModTimeMapNew map[string]fileRecord
+
+	// Records loaded from a cache file written by a previous run. They're
+	// consulted for any path that this process hasn't seen yet.
+	pathToModTimeMapPersisted map[string]fileRecord
+}
+
+// fileRecord is what's tracked about each file seen by the cache.
+type fileRecord struct {
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+
+	// Hash is a hex-encoded SHA-256 hash of the file's contents. It's only
+	// populated when using ChangeDetectionContentHash.
+	Hash string `json:"hash,omitempty"`
 }
 
 // newFileModTimeCache returns a new fileModTimeCache.
-func newFileModTimeCache(log LoggerInterface) *fileModTimeCache {
+func newFileModTimeCache(log LoggerInterface, detection ChangeDetection) *fileModTimeCache {
+	if detection == "" {
+		detection = ChangeDetectionModTime
+	}
+
 	return &fileModTimeCache{
-		log:                 log,
-		pathToModTimeMap:    make(map[string]time.Time),
-		pathToModTimeMapNew: make(map[string]time.Time),
+		detection:                 detection,
+		log:                       log,
+		pathToModTimeMap:          make(map[string]fileRecord),
+		pathToModTimeMapNew:       make(map[string]fileRecord),
+		pathToModTimeMapPersisted: make(map[string]fileRecord),
 	}
 }
 
-// changed returns whether the target path's modified time has changed since
-// the last time it was checked. It also saves the last modified time for
-// future checks. The second return value is whether or not the record was
-// already in the cache.
+// changed returns whether the target path has changed since the last time it
+// was checked. It also saves the file's current state for future checks. The
+// second return value is whether or not the record was already in the cache.
 func (c *fileModTimeCache) isFileUpdated(fileInfo os.FileInfo, absolutePath string) (bool, bool) {
-	modTime := fileInfo.ModTime()
+	lastRecord, ok := c.pathToModTimeMap[absolutePath]
+
+	// Not in the cache as far as the caller is concerned (it still needs to
+	// be watched), but it may have been seen by a previous run.
+	var persisted bool
+	if !ok {
+		lastRecord, persisted = c.pathToModTimeMapPersisted[absolutePath]
+	}
 
-	lastModTime, ok := c.pathToModTimeMap[absolutePath]
+	record, changed := c.compareRecord(absolutePath, fileInfo, lastRecord, ok || persisted)
 
-	if ok {
-		changed := lastModTime.Before(modTime)
-		if !changed {
-			return false, ok
-		}
+	// Return as early as possible in the common case of an unchanged file.
+	// With content hashes, store the record anyway so that its hash can be
+	// reused by other checks on the same file this round.
+	if ok && !changed && c.detection != ChangeDetectionContentHash {
+		return false, ok
 	}
 
 	// Store to the new map for eventual promotion.
 	c.mu.Lock()
-	c.pathToModTimeMapNew[absolutePath] = modTime
+	c.pathToModTimeMapNew[absolutePath] = record
+	c.mu.Unlock()
+
+	return changed, ok
+}
+
+// Produces a record for the file's current state and compares it to the last
+// record of the file according to the cache's change detection strategy.
+func (c *fileModTimeCache) compareRecord(absolutePath string, fileInfo os.FileInfo,
+	lastRecord fileRecord, hasLastRecord bool) (fileRecord, bool) {
+
+	record := fileRecord{ModTime: fileInfo.ModTime(), Size: fileInfo.Size()}
+
+	switch c.detection {
+	case ChangeDetectionContentHash:
+		record.Hash = c.hashFile(absolutePath, record)
+		return record, !hasLastRecord || record.Hash == "" || record.Hash != lastRecord.Hash
+
+	case ChangeDetectionSizeModTime:
+		return record, !hasLastRecord || record.Size != lastRecord.Size ||
+			!record.ModTime.Equal(lastRecord.ModTime)
+
+	default:
+		return record, !hasLastRecord || lastRecord.ModTime.Before(record.ModTime)
+	}
+}
+
+// Hashes the contents of the file at the given path. A hash computed earlier
+// in the same round is reused as long as the file's size and modification
+// time haven't changed since, so that each file is read at most once a
+// round.
+//
+// Returns an empty string if the file couldn't be read.
+func (c *fileModTimeCache) hashFile(absolutePath string, record fileRecord) string {
+	c.mu.Lock()
+	newRecord, ok := c.pathToModTimeMapNew[absolutePath]
 	c.mu.Unlock()
 
-	return true, ok
+	if ok && sameHashableRecord(newRecord, record) {
+		return newRecord.Hash
+	}
+
+	file, err := os.Open(absolutePath)
+	if err != nil {
+		c.log.Errorf("Error opening file for hashing: %v", err)
+		return ""
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		c.log.Errorf("Error hashing file: %v", err)
+		return ""
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Returns whether a record from earlier in the round has a hash that can be
+// reused for a file whose current record is given.
+func sameHashableRecord(previous, record fileRecord) bool {
+	return previous.Hash != "" && previous.Size == record.Size &&
+		previous.ModTime.Equal(record.ModTime)
+}
+
+// discard throws away the records collected during the current round without
+// promoting them, so that the files they describe are considered changed
+// again by the next round.
+func (c *fileModTimeCache) discard() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pathToModTimeMapNew = make(map[string]fileRecord)
 }
 
 // promote takes all the new modification times collected during this round
@@ -433,10 +1091,26 @@ func (c *fileModTimeCache) promote() {
 	defer c.mu.Unlock()
 
 	// Promote all new values to the current map.
-	for path, modTime := range c.pathToModTimeMapNew {
-		c.pathToModTimeMap[path] = modTime
+	for path, record := range c.pathToModTimeMapNew {
+		c.pathToModTimeMap[path] = record
 	}
 
 	// Clear the new map for the next round.
-	c.pathToModTimeMapNew = make(map[string]time.Time)
+	c.pathToModTimeMapNew = make(map[string]fileRecord)
+}
+
+// Returns whether path is dir or somewhere under it. Both should be clean,
+// and either both absolute or both relative.
+func pathWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Returns a copy of a set.
+func copyKeys(m map[string]struct{}) map[string]struct{} {
+	c := make(map[string]struct{}, len(m))
+	for k := range m {
+		c[k] = struct{}{}
+	}
+	return c
 }
@@ -1 +1,208 @@
 package modulir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestChanged_AfterDiscard(t *testing.T) {
+	path := writeTempFile(t, "contents")
+	defer os.Remove(path)
+
+	c := newContext()
+
+	assert.True(t, c.Changed(path))
+
+	// An aborted build discards what it saw, so the file is still considered
+	// changed in the next one.
+	c.fileModTimeCache.discard()
+	c.ResetBuild()
+	assert.True(t, c.Changed(path))
+
+	c.ResetBuild()
+	assert.False(t, c.Changed(path))
+}
+
+func TestChanged_ContentHash(t *testing.T) {
+	path := writeTempFile(t, "contents")
+	defer os.Remove(path)
+
+	c := NewContext(&Args{
+		ChangeDetection: ChangeDetectionContentHash,
+		Log:             &Logger{Level: LevelInfo},
+	})
+
+	assert.True(t, c.Changed(path))
+
+	// Touching the file doesn't count as a change.
+	c.ResetBuild()
+	touchFile(t, path, time.Now().Add(10*time.Second))
+	assert.False(t, c.Changed(path))
+
+	// But changing its contents does, even if the modification time stays
+	// the same.
+	c.ResetBuild()
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("new contents"), 0644))
+	touchFile(t, path, info.ModTime())
+	assert.True(t, c.Changed(path))
+
+	// Even when its size stays the same too.
+	c.ResetBuild()
+	info, err = os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("NEW CONTENTS"), 0644))
+	touchFile(t, path, info.ModTime())
+	assert.True(t, c.Changed(path))
+}
+
+func TestChanged_ModTime(t *testing.T) {
+	path := writeTempFile(t, "contents")
+	defer os.Remove(path)
+
+	c := newContext()
+
+	assert.True(t, c.Changed(path))
+
+	c.ResetBuild()
+	assert.False(t, c.Changed(path))
+
+	c.ResetBuild()
+	touchFile(t, path, time.Now().Add(10*time.Second))
+	assert.True(t, c.Changed(path))
+}
+
+func TestChanged_SizeModTime(t *testing.T) {
+	path := writeTempFile(t, "contents")
+	defer os.Remove(path)
+
+	c := NewContext(&Args{
+		ChangeDetection: ChangeDetectionSizeModTime,
+		Log:             &Logger{Level: LevelInfo},
+	})
+
+	assert.True(t, c.Changed(path))
+
+	c.ResetBuild()
+	assert.False(t, c.Changed(path))
+
+	// Moving the modification time backwards is a change.
+	c.ResetBuild()
+	touchFile(t, path, time.Now().Add(-10*time.Second))
+	assert.True(t, c.Changed(path))
+
+	// As is changing the file's size while keeping its modification time.
+	c.ResetBuild()
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("longer contents"), 0644))
+	touchFile(t, path, info.ModTime())
+	assert.True(t, c.Changed(path))
+}
+
+func TestWatchTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mkdir := func(name string) string {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(path, 0755))
+		return path
+	}
+
+	mkdir("content/drafts")
+	mkdir("content/node_modules/pkg")
+
+	watcher, err := fsnotify.NewWatcher()
+	assert.NoError(t, err)
+	defer watcher.Close()
+
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}, Watcher: watcher})
+
+	filter := func(path string) bool {
+		return filepath.Base(path) != "node_modules" && filepath.Ext(path) != ".tmp"
+	}
+	assert.NoError(t, c.WatchTree(filepath.Join(dir, "content"), filter))
+
+	watched := func() []string {
+		var paths []string
+		for path := range c.watchedPaths {
+			rel, err := filepath.Rel(dir, path)
+			assert.NoError(t, err)
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	// Filtered out directories and everything under them aren't watched.
+	assert.Equal(t, []string{"content", "content/drafts"}, watched())
+
+	// Registering the same tree again is a no-op.
+	assert.NoError(t, c.WatchTree(filepath.Join(dir, "content"), filter))
+	assert.Equal(t, []string{"content", "content/drafts"}, watched())
+
+	// New directories are watched, along with anything already in them.
+	{
+		path := mkdir("content/posts/2020")
+		c.updateWatched(fsnotify.Event{Name: filepath.Dir(path), Op: fsnotify.Create})
+		assert.Equal(t, []string{"content", "content/drafts", "content/posts", "content/posts/2020"},
+			watched())
+	}
+
+	// Unless they're filtered out.
+	{
+		path := mkdir("content/posts/node_modules")
+		c.updateWatched(fsnotify.Event{Name: path, Op: fsnotify.Create})
+		assert.Equal(t, []string{"content", "content/drafts", "content/posts", "content/posts/2020"},
+			watched())
+	}
+
+	// Removed directories are cleaned out, along with everything under them.
+	{
+		path := filepath.Join(dir, "content", "posts")
+		assert.NoError(t, os.RemoveAll(path))
+		c.updateWatched(fsnotify.Event{Name: path, Op: fsnotify.Remove})
+		assert.Equal(t, []string{"content", "content/drafts"}, watched())
+	}
+
+	// Changes to filtered out files are excluded.
+	assert.True(t, c.watchTreeExcludes(filepath.Join(dir, "content", "drafts", "a.tmp")))
+	assert.False(t, c.watchTreeExcludes(filepath.Join(dir, "content", "drafts", "a.md")))
+	assert.False(t, c.watchTreeExcludes(filepath.Join(dir, "other", "a.tmp")))
+}
+
+func TestPathWithin(t *testing.T) {
+	assert.True(t, pathWithin("content", "content"))
+	assert.True(t, pathWithin("content", "content/drafts/a.md"))
+	assert.True(t, pathWithin(".", "content"))
+	assert.False(t, pathWithin("content", "contents"))
+	assert.False(t, pathWithin("content", "other/a.md"))
+	assert.False(t, pathWithin("content/drafts", "content"))
+}
+
+// Helper to set the modification time of a file.
+func touchFile(t *testing.T, path string, modTime time.Time) {
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+// Helper to write a temporary file and return its path.
+func writeTempFile(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile("", "modulir")
+	assert.NoError(t, err)
+
+	_, err = file.WriteString(contents)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	return file.Name()
+}
@@ -0,0 +1,346 @@
+package modulir
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Path at which the build status dashboard is served by the development
+// server.
+const dashboardPath = "/_modulir"
+
+// Maximum number of recent change events that are kept for the dashboard.
+const maxRecentChanges = 20
+
+// Maximum number of slowest jobs shown on the dashboard.
+const maxDashboardSlowest = 10
+
+// Tracks the state of the build loop for the dashboard. It's updated by the
+// build loop and watcher, and read by HTTP handlers.
+//
+// It's safe for concurrent use.
+type buildStatus struct {
+	// Whether a build is currently running, and if so, when it started.
+	building   bool
+	buildStart time.Time
+
+	// Cancels the build that's currently running. Nil if there isn't one.
+	cancelBuild func()
+
+	// Recent change events picked up by the watcher, oldest first.
+	changes []*changeEvent
+
+	// Report on the last build to finish. Nil until one does.
+	lastBuild *buildReport
+
+	// When the last build finished.
+	lastBuildEnd time.Time
+
+	mu sync.Mutex
+}
+
+// A file change picked up by the watcher.
+type changeEvent struct {
+	Op   string
+	Path string
+	Time time.Time
+}
+
+// Cancels the build that's currently running, if there is one, and returns
+// whether there was.
+func (s *buildStatus) abortBuild() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.building || s.cancelBuild == nil {
+		return false
+	}
+
+	s.cancelBuild()
+	return true
+}
+
+// Marks a build as having finished. Report may be nil if the build was
+// aborted, in which case the last report is kept.
+func (s *buildStatus) finishBuild(report *buildReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.building = false
+	s.cancelBuild = nil
+
+	if report != nil {
+		s.lastBuild = report
+		s.lastBuildEnd = time.Now()
+	}
+}
+
+// Returns the report on the last build, or nil if no build has finished.
+func (s *buildStatus) lastReport() *buildReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastBuild
+}
+
+// Returns the report on the last build if it failed, and nil otherwise.
+func (s *buildStatus) lastFailure() *buildReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lastBuild == nil || s.lastBuild.Success {
+		return nil
+	}
+	return s.lastBuild
+}
+
+// Records a change event from the watcher.
+func (s *buildStatus) recordChange(event fsnotify.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changes = append(s.changes, &changeEvent{
+		Op:   event.Op.String(),
+		Path: event.Name,
+		Time: time.Now(),
+	})
+
+	if len(s.changes) > maxRecentChanges {
+		s.changes = s.changes[len(s.changes)-maxRecentChanges:]
+	}
+}
+
+// Marks a build as having started. Cancel cancels it, and may be nil if it
+// can't be canceled.
+func (s *buildStatus) startBuild(start time.Time, cancel func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.building = true
+	s.buildStart = start
+	s.cancelBuild = cancel
+}
+
+// Data rendered by the dashboard template.
+type dashboardData struct {
+	Building       bool
+	BuildStart     time.Time
+	BuildElapsed   time.Duration
+	Changes        []*changeEvent
+	LastBuild      *buildReport
+	LastBuildEnd   time.Time
+	NumWatched     int
+	RebuildEnabled bool
+	RebuildPath    string
+	RebuildPending bool
+	Slowest        []*buildReportJob
+	Workers        []*WorkerStatus
+}
+
+// Gathers everything shown on the dashboard.
+func newDashboardData(c *Context) *dashboardData {
+	data := &dashboardData{
+		RebuildPath: dashboardPath + "/rebuild",
+	}
+
+	c.status.mu.Lock()
+	data.Building = c.status.building
+	data.BuildStart = c.status.buildStart
+	data.LastBuild = c.status.lastBuild
+	data.LastBuildEnd = c.status.lastBuildEnd
+
+	// Reversed so that the most recent changes are on top.
+	for i := len(c.status.changes) - 1; i >= 0; i-- {
+		data.Changes = append(data.Changes, c.status.changes[i])
+	}
+	c.status.mu.Unlock()
+
+	if data.Building {
+		data.BuildElapsed = time.Now().Sub(data.BuildStart).Truncate(time.Millisecond)
+	}
+
+	if data.LastBuild != nil {
+		data.Slowest = append([]*buildReportJob(nil), data.LastBuild.Jobs...)
+		sort.SliceStable(data.Slowest, func(i, j int) bool {
+			return data.Slowest[j].DurationMs < data.Slowest[i].DurationMs
+		})
+		if len(data.Slowest) > maxDashboardSlowest {
+			data.Slowest = data.Slowest[:maxDashboardSlowest]
+		}
+	}
+
+	c.watchedPathsMu.RLock()
+	data.NumWatched = len(c.watchedPaths)
+	c.watchedPathsMu.RUnlock()
+
+	data.RebuildEnabled = c.forceRebuild != nil
+	data.RebuildPending = len(c.forceRebuild) > 0
+
+	if c.Pool != nil {
+		data.Workers = c.Pool.WorkerStatuses()
+	}
+
+	return data
+}
+
+// Serves the build status dashboard.
+func getDashboardHandler(c *Context) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+
+		err := dashboardTemplate.Execute(w, newDashboardData(c))
+		if err != nil {
+			c.Log.Errorf("Error executing template/writing dashboard: %v", err)
+			return
+		}
+	}
+}
+
+// Requests a forced full rebuild, then sends the user back to the dashboard.
+// The rebuild starts once the build loop is free. Responds with a 503 if
+// there's no build loop, like when only serving.
+func getDashboardRebuildHandler(c *Context) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if c.forceRebuild == nil {
+			http.Error(w, "Not building; rebuilds are unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		// Non-blocking because if a rebuild is already pending, there's no
+		// need to queue another one.
+		select {
+		case c.forceRebuild <- struct{}{}:
+			c.Log.Infof("Forced rebuild requested from dashboard")
+		default:
+		}
+
+		http.Redirect(w, r, dashboardPath, http.StatusSeeOther)
+	}
+}
+
+// Template for the dashboard. It refreshes itself every couple seconds.
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"ms": msDuration,
+	"since": func(t time.Time) time.Duration {
+		return time.Now().Sub(t).Truncate(time.Millisecond)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="2">
+<title>Modulir</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, sans-serif; font-size: 14px; margin: 2em; color: #222; }
+h1 { font-size: 20px; }
+h2 { font-size: 16px; margin-top: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 3px 12px 3px 0; text-align: left; vertical-align: top; }
+pre { background: #fdf2f2; margin: 0 0 1em; padding: 8px; white-space: pre-wrap; }
+.error { color: #c00; }
+.success { color: #080; }
+</style>
+</head>
+<body>
+<h1>Modulir</h1>
+
+{{if .RebuildEnabled}}
+<form method="post" action="{{.RebuildPath}}">
+<button type="submit"{{if .RebuildPending}} disabled{{end}}>Force full rebuild</button>
+{{if .RebuildPending}}(rebuild pending){{end}}
+</form>
+{{else}}
+<p>Serving only; rebuilds are unavailable.</p>
+{{end}}
+
+<h2>Current build</h2>
+{{if .Building}}
+<p>Building for {{.BuildElapsed}} (started {{.BuildStart.Format "15:04:05"}})</p>
+{{else}}
+<p>Idle</p>
+{{end}}
+
+<table>
+<tr><th>Worker</th><th>State</th><th>Job</th><th>Running for</th><th>Finished</th><th>Errored</th></tr>
+{{range .Workers}}
+<tr>
+<td>{{.Worker}}</td>
+<td>{{.State}}</td>
+<td>{{.Job}}</td>
+<td>{{if .Job}}{{since .JobStart}}{{end}}</td>
+<td>{{.NumJobsFinished}}</td>
+<td>{{.NumJobsErrored}}</td>
+</tr>
+{{end}}
+</table>
+
+<h2>Last build</h2>
+{{with .LastBuild}}
+<p>
+{{if .Success}}<span class="success">Succeeded</span>{{else}}<span class="error">Failed</span>{{end}}
+in {{ms .DurationMs}} at {{$.LastBuildEnd.Format "15:04:05"}}.
+{{.NumJobsExecuted}} of {{.NumJobs}} job(s) did work in {{.NumRounds}} round(s);
+{{.NumJobsErrored}} errored.
+</p>
+
+{{if .Errors}}
+<h2>Errors</h2>
+{{range .Errors}}<pre class="error">{{.}}</pre>{{end}}
+{{end}}
+
+<h2>Slowest jobs</h2>
+<table>
+<tr><th>Job</th><th>Time</th><th>Executed</th><th>Reason</th></tr>
+{{range $.Slowest}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{ms .DurationMs}}</td>
+<td>{{.Executed}}</td>
+<td>{{.Reason}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No build has finished yet.</p>
+{{end}}
+
+<h2>Watcher</h2>
+<p>Watching {{.NumWatched}} path(s).</p>
+
+<table>
+<tr><th>Time</th><th>Op</th><th>Path</th></tr>
+{{range .Changes}}
+<tr>
+<td>{{.Time.Format "15:04:05"}}</td>
+<td>{{.Op}}</td>
+<td>{{.Path}}</td>
+</tr>
+{{else}}
+<tr><td colspan="3">No changes seen yet.</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,106 @@
+package modulir
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestDashboardHandler(t *testing.T) {
+	c := NewContext(&Args{
+		Log:  &Logger{Level: LevelInfo},
+		Pool: NewPool(&Logger{Level: LevelInfo}, 2),
+	})
+
+	// Before any build
+	{
+		recorder := httptest.NewRecorder()
+		getDashboardHandler(c)(recorder, httptest.NewRequest("GET", dashboardPath, nil))
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "No build has finished yet.")
+		assert.Contains(t, recorder.Body.String(), "No changes seen yet.")
+	}
+
+	c.status.recordChange(fsnotify.Event{Name: "content/a.md", Op: fsnotify.Write})
+
+	c.StartRound()
+	c.status.startBuild(c.Stats.Start, nil)
+	c.AddJob("good job", func() (bool, error) { return true, nil })
+	c.AddJob("bad job", func() (bool, error) { return true, fmt.Errorf("something <broke>") })
+	errors := c.Wait()
+	c.Pool.Wait()
+	c.status.finishBuild(newBuildReport(c, c.Stats.JobsAll, errors, time.Second))
+
+	// After a failed build
+	{
+		recorder := httptest.NewRecorder()
+		getDashboardHandler(c)(recorder, httptest.NewRequest("GET", dashboardPath, nil))
+
+		body := recorder.Body.String()
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, body, "Failed")
+		assert.Contains(t, body, "something &lt;broke&gt;")
+		assert.Contains(t, body, "good job")
+		assert.Contains(t, body, "content/a.md")
+		assert.Contains(t, body, "Idle")
+	}
+}
+
+func TestDashboardRebuildHandler(t *testing.T) {
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+
+	// Only POST is allowed.
+	{
+		recorder := httptest.NewRecorder()
+		getDashboardRebuildHandler(c)(recorder,
+			httptest.NewRequest("GET", dashboardPath+"/rebuild", nil))
+
+		assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+		assert.Equal(t, 0, len(c.forceRebuild))
+	}
+
+	// Requests are coalesced while one is pending.
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		getDashboardRebuildHandler(c)(recorder,
+			httptest.NewRequest("POST", dashboardPath+"/rebuild", nil))
+
+		assert.Equal(t, http.StatusSeeOther, recorder.Code)
+		assert.Equal(t, dashboardPath, recorder.Header().Get("Location"))
+		assert.Equal(t, 1, len(c.forceRebuild))
+	}
+
+	// Without a build loop, like when only serving, rebuilds are refused and
+	// the dashboard doesn't offer them.
+	{
+		c.forceRebuild = nil
+
+		recorder := httptest.NewRecorder()
+		getDashboardRebuildHandler(c)(recorder,
+			httptest.NewRequest("POST", dashboardPath+"/rebuild", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+		recorder = httptest.NewRecorder()
+		getDashboardHandler(c)(recorder, httptest.NewRequest("GET", dashboardPath, nil))
+		assert.NotContains(t, recorder.Body.String(), "Force full rebuild")
+		assert.Contains(t, recorder.Body.String(), "rebuilds are unavailable")
+	}
+}
+
+func TestRecordChange(t *testing.T) {
+	status := &buildStatus{}
+
+	for i := 0; i < maxRecentChanges+5; i++ {
+		status.recordChange(fsnotify.Event{Name: fmt.Sprintf("path%v", i), Op: fsnotify.Write})
+	}
+
+	assert.Equal(t, maxRecentChanges, len(status.changes))
+	assert.Equal(t, "path5", status.changes[0].Path)
+	assert.Equal(t, fmt.Sprintf("path%v", maxRecentChanges+4), status.changes[maxRecentChanges-1].Path)
+}
@@ -3,9 +3,15 @@ package modulir
 //go:generate go run scripts/embed_js/main.go
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
@@ -25,16 +31,30 @@ import (
 //////////////////////////////////////////////////////////////////////////////
 
 // Starts serving the built site over HTTP on the configured port. A server
-// instance is returned so that it can be shut down gracefully.
-func startServingTargetDirHTTP(c *Context, buildComplete *sync.Cond) *http.Server {
-	c.Log.Infof("Serving '%s' to: http://localhost:%v/", path.Clean(c.TargetDir), c.Port)
+// instance is returned so that it can be shut down gracefully, along with a
+// channel that receives an error if serving fails after starting.
+//
+// Websocket connections, which aren't closed by shutting down the server, are
+// closed when ctx is canceled.
+func startServingTargetDirHTTP(ctx context.Context, c *Context,
+	buildComplete *sync.Cond) (*http.Server, <-chan error, error) {
+
+	fileHandler := newTargetDirHandler(c)
+
+	// Live reload is wired up by injecting the websocket script into pages
+	// as they're served so that built output stays production-clean.
+	if c.Websocket {
+		fileHandler = injectWebsocketScript(fileHandler)
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/", http.FileServer(http.Dir(c.TargetDir)))
+	mux.Handle("/", fileHandler)
+	mux.HandleFunc(dashboardPath, getDashboardHandler(c))
+	mux.HandleFunc(dashboardPath+"/rebuild", getDashboardRebuildHandler(c))
 
 	if c.Websocket {
 		mux.HandleFunc("/websocket.js", getWebsocketJSHandler(c))
-		mux.HandleFunc("/websocket", getWebsocketHandler(c, buildComplete))
+		mux.HandleFunc("/websocket", getWebsocketHandler(ctx, c, buildComplete))
 	}
 
 	server := &http.Server{
@@ -42,17 +62,31 @@ func startServingTargetDirHTTP(c *Context, buildComplete *sync.Cond) *http.Serve
 		Handler: mux,
 	}
 
+	// Listen up front so that a problem like the port being in use is
+	// returned right away.
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error starting HTTP server")
+	}
+
+	// Use the port that was actually bound in case it was picked by the
+	// system.
+	port := listener.Addr().(*net.TCPAddr).Port
+	c.Log.Infof("Serving '%s' to: http://localhost:%v/", path.Clean(c.TargetDir), port)
+	c.Log.Infof("Build status at: http://localhost:%v%s", port, dashboardPath)
+
+	serveErrs := make(chan error, 1)
 	go func() {
-		err := server.ListenAndServe()
+		err := server.Serve(listener)
 
-		// ListenAndServe always returns a non-nil error (but if started
-		// successfully, it'll block for a long time).
+		// Serve always returns a non-nil error (but if started successfully,
+		// it'll block for a long time).
 		if err != http.ErrServerClosed {
-			exitWithError(errors.Wrap(err, "Error starting HTTP server"))
+			serveErrs <- errors.Wrap(err, "Error serving HTTP")
 		}
 	}()
 
-	return server
+	return server, serveErrs, nil
 }
 
 //////////////////////////////////////////////////////////////////////////////
@@ -69,6 +103,70 @@ func startServingTargetDirHTTP(c *Context, buildComplete *sync.Cond) *http.Serve
 // and sending back over a websocket.
 type websocketEvent struct {
 	Type string `json:"type"`
+
+	// ChangedPaths are the URL paths of the outputs written by a build (as
+	// opposed to those left in place because they were up to date). Only
+	// sent with `build_complete`. Clients use them to decide whether they can
+	// apply changes in place (like swapping a stylesheet) instead of
+	// reloading the page.
+	ChangedPaths []string `json:"changed_paths,omitempty"`
+
+	// Errors are the errors of a failed build. Only sent with
+	// `build_failed`.
+	Errors []*websocketError `json:"errors,omitempty"`
+}
+
+// An error of a failed build sent over a websocket.
+type websocketError struct {
+	// Job is the name of the job that failed. Empty for errors that didn't
+	// come from a job.
+	Job string `json:"job,omitempty"`
+
+	Message string `json:"message"`
+}
+
+// Produces the event to send to clients after a build. A failed build sends
+// its errors so that they can be shown in the page instead of reloading it.
+func newBuildEvent(report *buildReport) *websocketEvent {
+	if report == nil {
+		return &websocketEvent{Type: "build_complete"}
+	}
+
+	if report.Success {
+		event := &websocketEvent{Type: "build_complete"}
+
+		// Changed paths are only sent if they're known to be complete.
+		// Otherwise, something like a page that was rewritten along with a
+		// stylesheet could be missed, leaving it stale while the stylesheet
+		// is swapped in place. Without them, clients reload.
+		if !report.WrittenOutputsComplete {
+			return event
+		}
+
+		for _, output := range report.WrittenOutputs {
+			event.ChangedPaths = append(event.ChangedPaths, "/"+filepath.ToSlash(output))
+		}
+		return event
+	}
+
+	event := &websocketEvent{Type: "build_failed"}
+
+	for _, job := range report.Jobs {
+		if job.Error != "" {
+			event.Errors = append(event.Errors,
+				&websocketError{Job: job.Name, Message: job.Error})
+		}
+	}
+
+	// Errors that didn't come from a job, like ones returned directly from
+	// the build function.
+	if len(event.Errors) < 1 {
+		for _, message := range report.Errors {
+			event.Errors = append(event.Errors, &websocketError{Message: message})
+		}
+	}
+
+	return event
 }
 
 const (
@@ -105,7 +203,8 @@ var websocketUpgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-func getWebsocketHandler(c *Context, buildComplete *sync.Cond) func(w http.ResponseWriter, r *http.Request) {
+func getWebsocketHandler(ctx context.Context, c *Context,
+	buildComplete *sync.Cond) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		conn, err := websocketUpgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -116,7 +215,7 @@ func getWebsocketHandler(c *Context, buildComplete *sync.Cond) func(w http.Respo
 		connClosed := make(chan struct{}, 1)
 
 		go websocketReadPump(c, conn, connClosed)
-		go websocketWritePump(c, conn, connClosed, buildComplete)
+		go websocketWritePump(ctx, c, conn, connClosed, buildComplete)
 		c.Log.Infof(logPrefix(c, conn) + "Opened")
 	}
 }
@@ -125,7 +224,7 @@ func getWebsocketJSHandler(c *Context) func(w http.ResponseWriter, r *http.Reque
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/javascript")
 		err := websocketJSTemplate.Execute(w, map[string]interface{}{
-			"Port": c.Port,
+			"WebsocketURL": c.WebsocketURL,
 		})
 
 		if err != nil {
@@ -135,6 +234,106 @@ func getWebsocketJSHandler(c *Context) func(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+// Wraps a handler so that the tag for the websocket script is injected into
+// any successful HTML response that doesn't already reference it.
+func injectWebsocketScript(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		injector := &scriptInjectingWriter{ResponseWriter: w}
+		handler.ServeHTTP(injector, r)
+		injector.finish(r)
+	})
+}
+
+// The tag injected into HTML pages to load the websocket script.
+const websocketScriptTag = `<script src="/websocket.js"></script>`
+
+// Inserts the websocket script tag into an HTML document just before its
+// closing body tag, or at the end if it doesn't have one. Documents that
+// already reference the script are left alone.
+func insertWebsocketScriptTag(body []byte) []byte {
+	if bytes.Contains(body, []byte("/websocket.js")) {
+		return body
+	}
+
+	i := bytes.LastIndex(bytes.ToLower(body), []byte("</body>"))
+	if i == -1 {
+		i = len(body)
+	}
+
+	injected := make([]byte, 0, len(body)+len(websocketScriptTag))
+	injected = append(injected, body[:i]...)
+	injected = append(injected, websocketScriptTag...)
+	injected = append(injected, body[i:]...)
+	return injected
+}
+
+// A response writer that buffers successful (or not found) HTML responses so
+// that the websocket script tag can be injected into them. Everything else is
+// passed straight through.
+type scriptInjectingWriter struct {
+	http.ResponseWriter
+
+	buf         bytes.Buffer
+	inject      bool
+	status      int
+	wroteHeader bool
+}
+
+func (w *scriptInjectingWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.inject {
+		return w.buf.Write(data)
+	}
+
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *scriptInjectingWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	// Partial content, not modified, encoded content, and the like are
+	// passed through as is. Not found pages get the script too so that they
+	// reload once the missing page is built.
+	header := w.Header()
+	if (status == http.StatusOK || status == http.StatusNotFound) &&
+		strings.HasPrefix(header.Get("Content-Type"), "text/html") &&
+		header.Get("Content-Encoding") == "" {
+
+		// Hold off on writing the header until the body is known.
+		w.inject = true
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Writes out a buffered response with the script tag injected. Must be
+// called after the wrapped handler has finished.
+func (w *scriptInjectingWriter) finish(r *http.Request) {
+	if !w.inject {
+		return
+	}
+
+	body := insertWebsocketScriptTag(w.buf.Bytes())
+
+	// The length of the response to a HEAD request isn't known because
+	// there's no body to inject into.
+	w.Header().Del("Content-Length")
+	if r.Method != http.MethodHead {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
 // Produces a log prefix like `<WebSocket [::1]:53555>` which is colored if
 // appropriate.
 func logPrefix(c *Context, conn *websocket.Conn) string {
@@ -176,7 +375,7 @@ func websocketReadPump(c *Context, conn *websocket.Conn, connClosed chan struct{
 	c.Log.Debugf(logPrefix(c, conn) + "Read pump ending")
 }
 
-func websocketWritePump(c *Context, conn *websocket.Conn,
+func websocketWritePump(ctx context.Context, c *Context, conn *websocket.Conn,
 	connClosed chan struct{}, buildComplete *sync.Cond) {
 
 	ticker := time.NewTicker(websocketPingPeriod)
@@ -226,11 +425,23 @@ func websocketWritePump(c *Context, conn *websocket.Conn,
 		c.Log.Debugf(logPrefix(c, conn) + "Build complete feeder ending")
 	}()
 
-	for {
+	// If the last build failed, let a newly connected client know right away
+	// so that it can show the errors.
+	if report := c.status.lastFailure(); report != nil {
+		conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+		writeErr = conn.WriteJSON(newBuildEvent(report))
+		if writeErr != nil {
+			c.Log.Errorf(logPrefix(c, conn)+"Error writing: %v",
+				writeErr)
+			done = true
+		}
+	}
+
+	for !done {
 		select {
 		case <-buildCompleteChan:
 			conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
-			writeErr = conn.WriteJSON(websocketEvent{Type: "build_complete"})
+			writeErr = conn.WriteJSON(newBuildEvent(c.status.lastReport()))
 
 			// Send shouldn't strictly need to be non-blocking, but we do one
 			// anyway just to hedge against future or unexpected problems so as
@@ -243,6 +454,11 @@ func websocketWritePump(c *Context, conn *websocket.Conn,
 		case <-connClosed:
 			done = true
 
+		// The server is shutting down, which doesn't close websockets on
+		// its own.
+		case <-ctx.Done():
+			done = true
+
 		case <-ticker.C:
 			c.Log.Debugf(logPrefix(c, conn) + "Sending ping")
 			conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
@@ -254,10 +470,6 @@ func websocketWritePump(c *Context, conn *websocket.Conn,
 				writeErr)
 			done = true
 		}
-
-		if done {
-			break
-		}
 	}
 
 	c.Log.Debugf(logPrefix(c, conn) + "Write pump ending")
@@ -1 +1,229 @@
 package modulir
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestNewBuildEvent(t *testing.T) {
+	// No build yet
+	assert.Equal(t, &websocketEvent{Type: "build_complete"}, newBuildEvent(nil))
+
+	// Successful build
+	assert.Equal(t, &websocketEvent{Type: "build_complete"},
+		newBuildEvent(&buildReport{Success: true}))
+
+	// Successful build with outputs
+	assert.Equal(t, &websocketEvent{
+		Type:         "build_complete",
+		ChangedPaths: []string{"/css/main.css", "/index.html"},
+	}, newBuildEvent(&buildReport{
+		Outputs:        []string{filepath.Join("css", "main.css"), "index.html", "link"},
+		Success:        true,
+		WrittenOutputs: []string{filepath.Join("css", "main.css"), "index.html"},
+
+		WrittenOutputsComplete: true,
+	}))
+
+	// Successful build with outputs that may be incomplete
+	assert.Equal(t, &websocketEvent{Type: "build_complete"},
+		newBuildEvent(&buildReport{
+			Outputs:        []string{filepath.Join("css", "main.css")},
+			Success:        true,
+			WrittenOutputs: []string{filepath.Join("css", "main.css")},
+		}))
+
+	// Failed job
+	assert.Equal(t, &websocketEvent{
+		Type: "build_failed",
+		Errors: []*websocketError{
+			{Job: "bad job", Message: "error"},
+		},
+	}, newBuildEvent(&buildReport{
+		Errors: []string{"error"},
+		Jobs: []*buildReportJob{
+			{Name: "good job"},
+			{Name: "bad job", Error: "error"},
+		},
+	}))
+
+	// Build error not from a job
+	assert.Equal(t, &websocketEvent{
+		Type: "build_failed",
+		Errors: []*websocketError{
+			{Message: "error"},
+		},
+	}, newBuildEvent(&buildReport{Errors: []string{"error"}}))
+}
+
+func TestNewBuildEvent_WrittenOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cssPath := filepath.Join(dir, "main.css")
+	indexPath := filepath.Join(dir, "index.html")
+	assert.NoError(t, ioutil.WriteFile(indexPath, []byte("<p>Hello</p>"), 0644))
+
+	c := NewContext(&Args{
+		Log:       &Logger{Level: LevelInfo},
+		Pool:      NewPool(&Logger{Level: LevelInfo}, 2),
+		TargetDir: dir,
+	})
+
+	c.StartRound()
+
+	// Runs because its output is missing.
+	c.AddJobWithOptions("css", func() (bool, error) {
+		return true, ioutil.WriteFile(cssPath, []byte("body { color: red; }"), 0644)
+	}, &JobOptions{Outputs: []string{cssPath}})
+
+	// Skipped because its output is up to date.
+	c.AddJobWithOptions("index", func() (bool, error) {
+		return true, nil
+	}, &JobOptions{Outputs: []string{indexPath}})
+
+	// Leaves an output in place, like a symlink that already exists.
+	c.AddJob("link", func() (bool, error) {
+		c.RecordOutput(filepath.Join(dir, "link"))
+		return false, nil
+	})
+
+	errors := c.Wait()
+	assert.Empty(t, errors)
+	c.Pool.Wait()
+
+	report := newBuildReport(c, c.Stats.JobsAll, errors, time.Second)
+	assert.True(t, report.Success)
+
+	// Everything is kept from pruning, but only the stylesheet is sent as
+	// changed so that it can be swapped in place.
+	assert.Equal(t, []string{"index.html", "link", "main.css"}, report.Outputs)
+	assert.Equal(t, &websocketEvent{
+		Type:         "build_complete",
+		ChangedPaths: []string{"/main.css"},
+	}, newBuildEvent(report))
+
+	// A job that does work without declaring its outputs, like one that
+	// renders a page itself, may have written anything, so no changed paths
+	// are sent and clients reload.
+	c.StartRound()
+
+	c.AddJob("page", func() (bool, error) {
+		return true, ioutil.WriteFile(filepath.Join(dir, "page.html"), []byte("<p>Page</p>"), 0644)
+	})
+
+	c.AddJob("copy css", func() (bool, error) {
+		err := ioutil.WriteFile(cssPath, []byte("body { color: blue; }"), 0644)
+		c.RecordWrittenOutput(cssPath)
+		return true, err
+	})
+
+	errors = c.Wait()
+	assert.Empty(t, errors)
+	c.Pool.Wait()
+
+	report = newBuildReport(c, c.Stats.JobsAll, errors, time.Second)
+	assert.True(t, report.Success)
+	assert.False(t, report.WrittenOutputsComplete)
+	assert.Equal(t, &websocketEvent{Type: "build_complete"}, newBuildEvent(report))
+}
+
+func TestInjectWebsocketScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name, contents string) {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+	}
+
+	writeFile("index.html", "<html><body><p>Hello</p></body></html>")
+	writeFile("injected.html", `<html><body><script src="/websocket.js"></script></body></html>`)
+	writeFile("main.css", "body { color: red; }")
+
+	handler := injectWebsocketScript(http.FileServer(http.Dir(dir)))
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	// HTML gets the script injected with a corrected length.
+	{
+		recorder := serve("GET", "/")
+		expected := `<html><body><p>Hello</p><script src="/websocket.js"></script></body></html>`
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, expected, recorder.Body.String())
+		assert.Equal(t, strconv.Itoa(len(expected)), recorder.Header().Get("Content-Length"))
+	}
+
+	// Pages already including the script are left alone.
+	{
+		recorder := serve("GET", "/injected.html")
+		assert.Equal(t, `<html><body><script src="/websocket.js"></script></body></html>`,
+			recorder.Body.String())
+	}
+
+	// Other content types are left alone.
+	{
+		recorder := serve("GET", "/main.css")
+		assert.Equal(t, "body { color: red; }", recorder.Body.String())
+	}
+
+	// As are errors.
+	{
+		recorder := serve("GET", "/missing.html")
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.NotContains(t, recorder.Body.String(), "websocket.js")
+	}
+}
+
+func TestInsertWebsocketScriptTag(t *testing.T) {
+	assert.Equal(t,
+		`<p>a</p><script src="/websocket.js"></script></BODY>`,
+		string(insertWebsocketScriptTag([]byte(`<p>a</p></BODY>`))))
+
+	// No closing body tag
+	assert.Equal(t,
+		`<p>a</p><script src="/websocket.js"></script>`,
+		string(insertWebsocketScriptTag([]byte(`<p>a</p>`))))
+}
+
+func TestWebsocketJSHandler(t *testing.T) {
+	// By default the URL is left to the script.
+	{
+		c := NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+
+		recorder := httptest.NewRecorder()
+		getWebsocketJSHandler(c)(recorder, httptest.NewRequest("GET", "/websocket.js", nil))
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "text/javascript", recorder.Header().Get("Content-Type"))
+		assert.Contains(t, recorder.Body.String(), `var configuredURL = "";`)
+	}
+
+	// An override is embedded in the script.
+	{
+		c := NewContext(&Args{
+			Log:          &Logger{Level: LevelInfo},
+			WebsocketURL: "wss://example.com/websocket",
+		})
+
+		recorder := httptest.NewRecorder()
+		getWebsocketJSHandler(c)(recorder, httptest.NewRequest("GET", "/websocket.js", nil))
+
+		assert.Contains(t, recorder.Body.String(),
+			`var configuredURL = "wss://example.com/websocket";`)
+	}
+}
@@ -8,23 +8,42 @@
 package modulir
 
 // Source: websocket.js
-const websocketJS = "function connect() {\n" +
-	"  var url = \"ws://localhost:{{.Port}}/websocket\";\n" +
+const websocketJS = "// ID of the element that shows the errors of a failed build.\n" +
+	"var overlayID = \"modulir-error-overlay\";\n" +
+	"\n" +
+	"// Bounds for the time to wait between attempts to reconnect, in milliseconds.\n" +
+	"// The delay doubles after every failed attempt.\n" +
+	"var reconnectDelayMin = 500;\n" +
+	"var reconnectDelayMax = 30000;\n" +
+	"var reconnectDelay = reconnectDelayMin;\n" +
+	"\n" +
+	"// Where this script was loaded from. Only available while the script is\n" +
+	"// first running, so it's captured up front.\n" +
+	"var scriptSrc = document.currentScript ? document.currentScript.src : null;\n" +
+	"\n" +
+	"// An explicit URL for the websocket configured on the server. Empty if not\n" +
+	"// set.\n" +
+	"var configuredURL = \"{{js .WebsocketURL}}\";\n" +
+	"\n" +
+	"function connect() {\n" +
+	"  var url = websocketURL();\n" +
 	"\n" +
 	"  console.log(`Connecting to Modulir: ${url}`);\n" +
 	"  var socket = new WebSocket(url);\n" +
 	"\n" +
 	"  socket.onclose = function(event) {\n" +
-	"    console.log(\"Websocket connection closed or unable to connect; starting reconnect timeout\");\n" +
+	"    console.log(`Websocket connection closed or unable to connect; reconnecting in ${reconnectDelay}ms`);\n" +
 	"\n" +
 	"    // Allow the last socket to be cleaned up.\n" +
 	"    socket = null;\n" +
 	"\n" +
-	"    // Set an interval to continue trying to reconnect periodically until we\n" +
-	"    // succeed.\n" +
+	"    // Keep trying to reconnect until we succeed, backing off a little more\n" +
+	"    // each time.\n" +
 	"    setTimeout(function() {\n" +
 	"      connect();\n" +
-	"    }, 5000)\n" +
+	"    }, reconnectDelay);\n" +
+	"\n" +
+	"    reconnectDelay = Math.min(reconnectDelay * 2, reconnectDelayMax);\n" +
 	"  }\n" +
 	"\n" +
 	"  socket.onmessage = function(event) {\n" +
@@ -34,6 +53,15 @@ const websocketJS = "function connect() {\n" +
 	"\n" +
 	"    switch(data.type) {\n" +
 	"      case \"build_complete\":\n" +
+	"        // If the only things that changed were stylesheets, swap them in\n" +
+	"        // place, which keeps the page's scroll position and form state.\n" +
+	"        if (onlyStylesheetsChanged(data.changed_paths)) {\n" +
+	"          console.log(\"Only stylesheets changed; swapping them in place\");\n" +
+	"          hideErrorOverlay();\n" +
+	"          swapStylesheets(data.changed_paths);\n" +
+	"          break;\n" +
+	"        }\n" +
+	"\n" +
 	"        // 1000 = \"Normal closure\" and the second parameter is a human-readable\n" +
 	"        // reason.\n" +
 	"        socket.close(1000, \"Reloading page after receiving build_complete\");\n" +
@@ -43,6 +71,15 @@ const websocketJS = "function connect() {\n" +
 	"\n" +
 	"        break;\n" +
 	"\n" +
+	"      case \"build_failed\":\n" +
+	"        // Don't reload into what's probably stale or broken output. Show\n" +
+	"        // the errors instead. They'll be cleared by the reload that follows\n" +
+	"        // the next successful build.\n" +
+	"        console.log(\"Build failed; showing errors\");\n" +
+	"        showErrorOverlay(data.errors || []);\n" +
+	"\n" +
+	"        break;\n" +
+	"\n" +
 	"      default:\n" +
 	"        console.log(`Don't know how to handle type '${data.type}'`);\n" +
 	"    }\n" +
@@ -50,8 +87,122 @@ const websocketJS = "function connect() {\n" +
 	"\n" +
 	"  socket.onopen = function(event) {\n" +
 	"    console.log(\"Websocket connected\");\n" +
+	"    reconnectDelay = reconnectDelayMin;\n" +
 	"  }\n" +
 	"}\n" +
 	"\n" +
+	"// Produces the URL of the websocket. Unless one was configured, it's found\n" +
+	"// next to this script, which works even when pages are being served from a\n" +
+	"// different host or port (say through a proxy or port mapping). Failing that,\n" +
+	"// it's derived from the page's location. The scheme follows the page's so\n" +
+	"// that HTTPS pages use a secure websocket.\n" +
+	"function websocketURL() {\n" +
+	"  if (configuredURL) {\n" +
+	"    return configuredURL;\n" +
+	"  }\n" +
+	"\n" +
+	"  var url = scriptSrc ? new URL(\"websocket\", scriptSrc) : new URL(\"/websocket\", location.href);\n" +
+	"  url.protocol = url.protocol === \"https:\" ? \"wss:\" : \"ws:\";\n" +
+	"  return url.toString();\n" +
+	"}\n" +
+	"\n" +
+	"// Whether every one of the given changed paths is a stylesheet. Returns false\n" +
+	"// if there are none because then it's not known what changed.\n" +
+	"function onlyStylesheetsChanged(paths) {\n" +
+	"  if (!paths || paths.length < 1) {\n" +
+	"    return false;\n" +
+	"  }\n" +
+	"\n" +
+	"  return paths.every(function(path) {\n" +
+	"    return path.endsWith(\".css\");\n" +
+	"  });\n" +
+	"}\n" +
+	"\n" +
+	"// Points any stylesheet links in the page whose paths changed back at\n" +
+	"// themselves with a cache-busting parameter so that the browser reloads them.\n" +
+	"function swapStylesheets(paths) {\n" +
+	"  var links = document.querySelectorAll(\"link[rel=stylesheet]\");\n" +
+	"\n" +
+	"  links.forEach(function(link) {\n" +
+	"    var url = new URL(link.href, location.href);\n" +
+	"\n" +
+	"    // Only stylesheets served by this server.\n" +
+	"    if (url.origin !== location.origin || !paths.includes(url.pathname)) {\n" +
+	"      return;\n" +
+	"    }\n" +
+	"\n" +
+	"    url.searchParams.set(\"modulir\", Date.now());\n" +
+	"    console.log(`Swapping stylesheet: ${url.pathname}`);\n" +
+	"    link.href = url.toString();\n" +
+	"  });\n" +
+	"}\n" +
+	"\n" +
+	"// Removes the error overlay if it's being shown.\n" +
+	"function hideErrorOverlay() {\n" +
+	"  var overlay = document.getElementById(overlayID);\n" +
+	"  if (overlay) {\n" +
+	"    overlay.parentNode.removeChild(overlay);\n" +
+	"  }\n" +
+	"}\n" +
+	"\n" +
+	"// Shows the errors of a failed build in an overlay over the page, replacing\n" +
+	"// any that's already shown.\n" +
+	"function showErrorOverlay(errors) {\n" +
+	"  hideErrorOverlay();\n" +
+	"\n" +
+	"  var overlay = document.createElement(\"div\");\n" +
+	"  overlay.id = overlayID;\n" +
+	"  overlay.style.cssText = [\n" +
+	"    \"background: rgba(20, 20, 20, 0.92)\",\n" +
+	"    \"bottom: 0\",\n" +
+	"    \"box-sizing: border-box\",\n" +
+	"    \"color: #eee\",\n" +
+	"    \"font: 14px/1.4 Menlo, Consolas, monospace\",\n" +
+	"    \"left: 0\",\n" +
+	"    \"overflow: auto\",\n" +
+	"    \"padding: 2em\",\n" +
+	"    \"position: fixed\",\n" +
+	"    \"right: 0\",\n" +
+	"    \"top: 0\",\n" +
+	"    \"z-index: 2147483647\",\n" +
+	"  ].join(\";\");\n" +
+	"\n" +
+	"  var dismiss = document.createElement(\"button\");\n" +
+	"  dismiss.textContent = \"Dismiss\";\n" +
+	"  dismiss.style.cssText = \"cursor: pointer; float: right; font: inherit;\";\n" +
+	"  dismiss.onclick = hideErrorOverlay;\n" +
+	"  overlay.appendChild(dismiss);\n" +
+	"\n" +
+	"  var heading = document.createElement(\"h2\");\n" +
+	"  heading.textContent = `Modulir build failed with ${errors.length} error(s)`;\n" +
+	"  heading.style.cssText = \"color: #ff6b6b; font: inherit; font-weight: bold; margin: 0 0 1em;\";\n" +
+	"  overlay.appendChild(heading);\n" +
+	"\n" +
+	"  errors.forEach(function(error) {\n" +
+	"    if (error.job) {\n" +
+	"      var job = document.createElement(\"div\");\n" +
+	"      job.textContent = `Job: ${error.job}`;\n" +
+	"      job.style.cssText = \"color: #aaa;\";\n" +
+	"      overlay.appendChild(job);\n" +
+	"    }\n" +
+	"\n" +
+	"    // Using textContent means that error messages are never interpreted\n" +
+	"    // as HTML.\n" +
+	"    var message = document.createElement(\"pre\");\n" +
+	"    message.textContent = error.message;\n" +
+	"    message.style.cssText = \"margin: 0 0 1.5em; white-space: pre-wrap;\";\n" +
+	"    overlay.appendChild(message);\n" +
+	"  });\n" +
+	"\n" +
+	"  document.body.appendChild(overlay);\n" +
+	"}\n" +
+	"\n" +
+	"// Allow the overlay to be dismissed with the escape key as well.\n" +
+	"document.addEventListener(\"keydown\", function(event) {\n" +
+	"  if (event.key === \"Escape\") {\n" +
+	"    hideErrorOverlay();\n" +
+	"  }\n" +
+	"});\n" +
+	"\n" +
 	"connect();\n" +
 	""
@@ -1,20 +1,39 @@
+// ID of the element that shows the errors of a failed build.
+var overlayID = "modulir-error-overlay";
+
+// Bounds for the time to wait between attempts to reconnect, in milliseconds.
+// The delay doubles after every failed attempt.
+var reconnectDelayMin = 500;
+var reconnectDelayMax = 30000;
+var reconnectDelay = reconnectDelayMin;
+
+// Where this script was loaded from. Only available while the script is
+// first running, so it's captured up front.
+var scriptSrc = document.currentScript ? document.currentScript.src : null;
+
+// An explicit URL for the websocket configured on the server. Empty if not
+// set.
+var configuredURL = "{{js .WebsocketURL}}";
+
 function connect() {
-  var url = "ws://localhost:{{.Port}}/websocket";
+  var url = websocketURL();
 
   console.log(`Connecting to Modulir: ${url}`);
   var socket = new WebSocket(url);
 
   socket.onclose = function(event) {
-    console.log("Websocket connection closed or unable to connect; starting reconnect timeout");
+    console.log(`Websocket connection closed or unable to connect; reconnecting in ${reconnectDelay}ms`);
 
     // Allow the last socket to be cleaned up.
     socket = null;
 
-    // Set an interval to continue trying to reconnect periodically until we
-    // succeed.
+    // Keep trying to reconnect until we succeed, backing off a little more
+    // each time.
     setTimeout(function() {
       connect();
-    }, 5000)
+    }, reconnectDelay);
+
+    reconnectDelay = Math.min(reconnectDelay * 2, reconnectDelayMax);
   }
 
   socket.onmessage = function(event) {
@@ -24,6 +43,15 @@ function connect() {
 
     switch(data.type) {
       case "build_complete":
+        // If the only things that changed were stylesheets, swap them in
+        // place, which keeps the page's scroll position and form state.
+        if (onlyStylesheetsChanged(data.changed_paths)) {
+          console.log("Only stylesheets changed; swapping them in place");
+          hideErrorOverlay();
+          swapStylesheets(data.changed_paths);
+          break;
+        }
+
         // 1000 = "Normal closure" and the second parameter is a human-readable
         // reason.
         socket.close(1000, "Reloading page after receiving build_complete");
@@ -33,6 +61,15 @@ function connect() {
 
         break;
 
+      case "build_failed":
+        // Don't reload into what's probably stale or broken output. Show
+        // the errors instead. They'll be cleared by the reload that follows
+        // the next successful build.
+        console.log("Build failed; showing errors");
+        showErrorOverlay(data.errors || []);
+
+        break;
+
       default:
         console.log(`Don't know how to handle type '${data.type}'`);
     }
@@ -40,7 +77,121 @@ function connect() {
 
   socket.onopen = function(event) {
     console.log("Websocket connected");
+    reconnectDelay = reconnectDelayMin;
   }
 }
 
+// Produces the URL of the websocket. Unless one was configured, it's found
+// next to this script, which works even when pages are being served from a
+// different host or port (say through a proxy or port mapping). Failing that,
+// it's derived from the page's location. The scheme follows the page's so
+// that HTTPS pages use a secure websocket.
+function websocketURL() {
+  if (configuredURL) {
+    return configuredURL;
+  }
+
+  var url = scriptSrc ? new URL("websocket", scriptSrc) : new URL("/websocket", location.href);
+  url.protocol = url.protocol === "https:" ? "wss:" : "ws:";
+  return url.toString();
+}
+
+// Whether every one of the given changed paths is a stylesheet. Returns false
+// if there are none because then it's not known what changed.
+function onlyStylesheetsChanged(paths) {
+  if (!paths || paths.length < 1) {
+    return false;
+  }
+
+  return paths.every(function(path) {
+    return path.endsWith(".css");
+  });
+}
+
+// Points any stylesheet links in the page whose paths changed back at
+// themselves with a cache-busting parameter so that the browser reloads them.
+function swapStylesheets(paths) {
+  var links = document.querySelectorAll("link[rel=stylesheet]");
+
+  links.forEach(function(link) {
+    var url = new URL(link.href, location.href);
+
+    // Only stylesheets served by this server.
+    if (url.origin !== location.origin || !paths.includes(url.pathname)) {
+      return;
+    }
+
+    url.searchParams.set("modulir", Date.now());
+    console.log(`Swapping stylesheet: ${url.pathname}`);
+    link.href = url.toString();
+  });
+}
+
+// Removes the error overlay if it's being shown.
+function hideErrorOverlay() {
+  var overlay = document.getElementById(overlayID);
+  if (overlay) {
+    overlay.parentNode.removeChild(overlay);
+  }
+}
+
+// Shows the errors of a failed build in an overlay over the page, replacing
+// any that's already shown.
+function showErrorOverlay(errors) {
+  hideErrorOverlay();
+
+  var overlay = document.createElement("div");
+  overlay.id = overlayID;
+  overlay.style.cssText = [
+    "background: rgba(20, 20, 20, 0.92)",
+    "bottom: 0",
+    "box-sizing: border-box",
+    "color: #eee",
+    "font: 14px/1.4 Menlo, Consolas, monospace",
+    "left: 0",
+    "overflow: auto",
+    "padding: 2em",
+    "position: fixed",
+    "right: 0",
+    "top: 0",
+    "z-index: 2147483647",
+  ].join(";");
+
+  var dismiss = document.createElement("button");
+  dismiss.textContent = "Dismiss";
+  dismiss.style.cssText = "cursor: pointer; float: right; font: inherit;";
+  dismiss.onclick = hideErrorOverlay;
+  overlay.appendChild(dismiss);
+
+  var heading = document.createElement("h2");
+  heading.textContent = `Modulir build failed with ${errors.length} error(s)`;
+  heading.style.cssText = "color: #ff6b6b; font: inherit; font-weight: bold; margin: 0 0 1em;";
+  overlay.appendChild(heading);
+
+  errors.forEach(function(error) {
+    if (error.job) {
+      var job = document.createElement("div");
+      job.textContent = `Job: ${error.job}`;
+      job.style.cssText = "color: #aaa;";
+      overlay.appendChild(job);
+    }
+
+    // Using textContent means that error messages are never interpreted
+    // as HTML.
+    var message = document.createElement("pre");
+    message.textContent = error.message;
+    message.style.cssText = "margin: 0 0 1.5em; white-space: pre-wrap;";
+    overlay.appendChild(message);
+  });
+
+  document.body.appendChild(overlay);
+}
+
+// Allow the overlay to be dismissed with the escape key as well.
+document.addEventListener("keydown", function(event) {
+  if (event.key === "Escape") {
+    hideErrorOverlay();
+  }
+});
+
 connect();
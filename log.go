@@ -1,9 +1,12 @@
 package modulir
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/logrusorgru/aurora"
 )
@@ -38,8 +41,53 @@ const (
 // Level represents a logging level.
 type Level uint32
 
-// Logger is a basic implementation of LoggerInterface.
+// LogColorMode determines whether log messages are colored.
+type LogColorMode string
+
+// The possible modes for coloring log messages.
+const (
+	// LogColorAlways colors messages regardless of where they're going.
+	LogColorAlways LogColorMode = "always"
+
+	// LogColorAuto colors messages when stdout and stderr are both
+	// terminals. Setting the NO_COLOR environment variable (or a TERM of
+	// "dumb") turns colors off, and setting FORCE_COLOR turns them on even
+	// when output isn't going to a terminal, like in some CI environments.
+	// NO_COLOR wins if both are set.
+	LogColorAuto LogColorMode = "auto"
+
+	// LogColorNever never colors messages.
+	LogColorNever LogColorMode = "never"
+)
+
+// LogFormat is a format in which Logger writes messages.
+type LogFormat string
+
+// The possible formats of Logger.
+const (
+	// LogFormatText writes messages as lines of text like:
+	//
+	//     [INFO] Built site in 1.5s (job: 'render', worker: 3)
+	LogFormatText LogFormat = "text"
+
+	// LogFormatJSON writes messages as lines of JSON, each an object with
+	// "time", "level", and "msg" properties along with any fields, like:
+	//
+	//     {"level":"info","msg":"Built site in 1.5s","job":"render","time":"...","worker":3}
+	//
+	// Durations are written as strings like "1.5s". Consider turning off
+	// LogColor so that messages don't include escape sequences.
+	LogFormatJSON LogFormat = "json"
+)
+
+// Logger is a basic implementation of LoggerInterface and
+// StructuredLoggerInterface.
 type Logger struct {
+	// Format is the format in which messages are written.
+	//
+	// Defaults to LogFormatText.
+	Format LogFormat
+
 	// Level is the minimum logging level that will be emitted by this logger.
 	//
 	// For example, a Level set to LevelWarn will emit warnings and errors, but
@@ -49,6 +97,9 @@ type Logger struct {
 	// values are not guaranteed to be stable.
 	Level Level
 
+	// Fields included with every message, as alternating keys and values.
+	fields []interface{}
+
 	// Internal testing use only.
 	stderrOverride io.Writer
 	stdoutOverride io.Writer
@@ -56,31 +107,71 @@ type Logger struct {
 
 // Debugf logs a debug message using Printf conventions.
 func (l *Logger) Debugf(format string, v ...interface{}) {
-	if l.Level >= LevelDebug {
-		fmt.Fprintf(l.stdout(), "[DEBUG] "+format+"\n", v...)
-	}
+	l.log(LevelDebug, l.stdout(), format, v)
 }
 
 // Errorf logs a warning message using Printf conventions.
 func (l *Logger) Errorf(format string, v ...interface{}) {
-	// Infof logs a debug message using Printf conventions.
-	if l.Level >= LevelError {
-		fmt.Fprintf(l.stderr(), "[ERROR] "+format+"\n", v...)
-	}
+	l.log(LevelError, l.stderr(), format, v)
 }
 
 // Infof logs an informational message using Printf conventions.
 func (l *Logger) Infof(format string, v ...interface{}) {
-	if l.Level >= LevelInfo {
-		fmt.Fprintf(l.stdout(), "[INFO] "+format+"\n", v...)
-	}
+	l.log(LevelInfo, l.stdout(), format, v)
 }
 
 // Warnf logs a warning message using Printf conventions.
 func (l *Logger) Warnf(format string, v ...interface{}) {
-	if l.Level >= LevelWarn {
-		fmt.Fprintf(l.stderr(), "[WARN] "+format+"\n", v...)
+	l.log(LevelWarn, l.stderr(), format, v)
+}
+
+// With returns a logger that includes the given fields with every message.
+// See StructuredLoggerInterface.
+func (l *Logger) With(keysAndValues ...interface{}) LoggerInterface {
+	return &Logger{
+		Format: l.Format,
+		Level:  l.Level,
+
+		fields:         appendFields(l.fields, keysAndValues),
+		stderrOverride: l.stderrOverride,
+		stdoutOverride: l.stdoutOverride,
+	}
+}
+
+func (l *Logger) log(level Level, w io.Writer, format string, v []interface{}) {
+	if l.Level < level {
+		return
 	}
+
+	message := fmt.Sprintf(format, v...)
+
+	if l.Format == LogFormatJSON {
+		entry := make(map[string]interface{})
+		eachField(l.fields, func(key string, val interface{}) {
+			if duration, ok := val.(time.Duration); ok {
+				val = duration.String()
+			}
+			if err, ok := val.(error); ok {
+				val = err.Error()
+			}
+			entry[key] = val
+		})
+
+		entry["level"] = levelName(level)
+		entry["msg"] = message
+		entry["time"] = time.Now().Format(time.RFC3339Nano)
+
+		raw, err := json.Marshal(entry)
+		if err != nil {
+			fmt.Fprintf(w, "[ERROR] Error marshaling log message: %v\n", err)
+			return
+		}
+
+		fmt.Fprintf(w, "%s\n", raw)
+		return
+	}
+
+	fmt.Fprintf(w, "[%s] %s%s\n", strings.ToUpper(levelName(level)), message, formatFields(l.fields))
 }
 
 func (l *Logger) stderr() io.Writer {
@@ -116,6 +207,36 @@ type LoggerInterface interface {
 	Warnf(format string, v ...interface{})
 }
 
+// StructuredLoggerInterface is an interface that can be implemented by loggers
+// that support fields, which are key/value pairs giving context to messages
+// like the name of the job that they're about. Modulir sends fields to
+// loggers that implement it, and appends them to the text of messages for
+// those that don't.
+//
+// Logger implements it, and SlogLogger adapts a logger from `log/slog` to
+// it.
+type StructuredLoggerInterface interface {
+	LoggerInterface
+
+	// With returns a logger that includes the given fields with every
+	// message. Fields are given as alternating keys and values like:
+	//
+	//     log.With("job", job.Name, "worker", 3)
+	With(keysAndValues ...interface{}) LoggerInterface
+}
+
+// WithFields returns a logger that includes the given fields (as alternating
+// keys and values) with every message. If log implements
+// StructuredLoggerInterface, the fields are passed along to it. Otherwise,
+// they're appended to the text of messages like "(job: 'render', worker: 3)".
+func WithFields(log LoggerInterface, keysAndValues ...interface{}) LoggerInterface {
+	if structured, ok := log.(StructuredLoggerInterface); ok {
+		return structured.With(keysAndValues...)
+	}
+
+	return &textFieldsLogger{log: log, fields: keysAndValues}
+}
+
 //////////////////////////////////////////////////////////////////////////////
 //
 //
@@ -126,6 +247,145 @@ type LoggerInterface interface {
 //
 //////////////////////////////////////////////////////////////////////////////
 
+// Key used for a value without one, like when an odd number of keys and
+// values is given. Matches `log/slog`.
+const badFieldKey = "!BADKEY"
+
+// Combines fields given as alternating keys and values into a new slice.
+func appendFields(fields []interface{}, keysAndValues []interface{}) []interface{} {
+	combined := make([]interface{}, 0, len(fields)+len(keysAndValues))
+	combined = append(combined, fields...)
+	return append(combined, keysAndValues...)
+}
+
+// Calls fn for each field in a slice of alternating keys and values.
+func eachField(keysAndValues []interface{}, fn func(key string, val interface{})) {
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i == len(keysAndValues)-1 {
+			fn(badFieldKey, keysAndValues[i])
+			break
+		}
+
+		key, ok := keysAndValues[i].(string)
+		if !ok {
+			key = fmt.Sprintf("%v", keysAndValues[i])
+		}
+		fn(key, keysAndValues[i+1])
+	}
+}
+
+// Formats fields to be appended to the text of a message like
+// " (job: 'render', worker: 3)". Returns an empty string if there are none.
+func formatFields(keysAndValues []interface{}) string {
+	if len(keysAndValues) < 1 {
+		return ""
+	}
+
+	var parts []string
+	eachField(keysAndValues, func(key string, val interface{}) {
+		if s, ok := val.(string); ok {
+			parts = append(parts, fmt.Sprintf("%s: '%s'", key, s))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s: %v", key, val))
+		}
+	})
+
+	return " (" + strings.Join(parts, ", ") + ")"
+}
+
+// Whether the given file is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Returns the name of a level as accepted by parseLevel.
+func levelName(level Level) string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelError:
+		return "error"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "info"
+	}
+}
+
+// Parses the name of a level.
+func parseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "error":
+		return LevelError, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	default:
+		return 0, fmt.Errorf("Invalid log level (should be one of debug, info, warn, or error): %s", name)
+	}
+}
+
+// Determines whether log messages should be colored in the given mode. See
+// LogColorAuto for how terminal (whether output is going to one) and the
+// environment are taken into account.
+func shouldColorLog(mode LogColorMode, getenv func(string) string, terminal bool) bool {
+	switch mode {
+	case LogColorAlways:
+		return true
+	case LogColorNever:
+		return false
+	}
+
+	// See: https://no-color.org
+	if getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	if force := getenv("FORCE_COLOR"); force != "" {
+		return force != "0" && force != "false"
+	}
+
+	if getenv("TERM") == "dumb" {
+		return false
+	}
+
+	return terminal
+}
+
+// Wraps a logger that doesn't support fields so that fields are appended to
+// the text of its messages instead.
+type textFieldsLogger struct {
+	log    LoggerInterface
+	fields []interface{}
+}
+
+func (l *textFieldsLogger) Debugf(format string, v ...interface{}) {
+	l.log.Debugf(format+"%s", append(v[:len(v):len(v)], formatFields(l.fields))...)
+}
+
+func (l *textFieldsLogger) Errorf(format string, v ...interface{}) {
+	l.log.Errorf(format+"%s", append(v[:len(v):len(v)], formatFields(l.fields))...)
+}
+
+func (l *textFieldsLogger) Infof(format string, v ...interface{}) {
+	l.log.Infof(format+"%s", append(v[:len(v):len(v)], formatFields(l.fields))...)
+}
+
+func (l *textFieldsLogger) Warnf(format string, v ...interface{}) {
+	l.log.Warnf(format+"%s", append(v[:len(v):len(v)], formatFields(l.fields))...)
+}
+
+func (l *textFieldsLogger) With(keysAndValues ...interface{}) LoggerInterface {
+	return &textFieldsLogger{log: l.log, fields: appendFields(l.fields, keysAndValues)}
+}
+
 type colorizer struct {
 	LogColor bool
 }
@@ -1 +1,145 @@
 package modulir
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	logger := &Logger{Level: LevelInfo, stderrOverride: &stderr, stdoutOverride: &stdout}
+
+	logger.Debugf("debug")
+	logger.Infof("info %v", 1)
+	logger.Warnf("warn")
+	logger.With("job", "render", "worker", 3).Errorf("error")
+
+	assert.Equal(t, "[INFO] info 1\n", stdout.String())
+	assert.Equal(t, "[WARN] warn\n[ERROR] error (job: 'render', worker: 3)\n", stderr.String())
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var stdout bytes.Buffer
+	logger := &Logger{Format: LogFormatJSON, Level: LevelInfo, stdoutOverride: &stdout}
+
+	WithFields(logger.With("job", "render"), "duration", 1500*time.Millisecond, "err", fmt.Errorf("oops")).
+		Infof("Built %v", "site")
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(stdout.Bytes(), &entry))
+
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "Built site", entry["msg"])
+	assert.Equal(t, "render", entry["job"])
+	assert.Equal(t, "1.5s", entry["duration"])
+	assert.Equal(t, "oops", entry["err"])
+
+	_, err := time.Parse(time.RFC3339Nano, entry["time"].(string))
+	assert.NoError(t, err)
+}
+
+func TestWithFields(t *testing.T) {
+	// Loggers supporting fields get them passed through.
+	{
+		var stdout bytes.Buffer
+		logger := &Logger{Format: LogFormatJSON, Level: LevelInfo, stdoutOverride: &stdout}
+
+		WithFields(logger, "job", "render").Infof("message")
+
+		var entry map[string]interface{}
+		assert.NoError(t, json.Unmarshal(stdout.Bytes(), &entry))
+		assert.Equal(t, "render", entry["job"])
+		assert.Equal(t, "message", entry["msg"])
+	}
+
+	// Others get them appended to messages.
+	{
+		logger := &recordingLogger{}
+
+		WithFields(WithFields(logger, "job", "100%"), "round", 1).Warnf("message %v", 1)
+		WithFields(logger, "odd").Infof("message")
+
+		assert.Equal(t, []string{
+			"message 1 (job: '100%', round: 1)",
+			"message (!BADKEY: 'odd')",
+		}, logger.messages)
+	}
+}
+
+// A logger that doesn't support fields and remembers its messages.
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Debugf(format string, v ...interface{}) { l.record(format, v) }
+func (l *recordingLogger) Errorf(format string, v ...interface{}) { l.record(format, v) }
+func (l *recordingLogger) Infof(format string, v ...interface{})  { l.record(format, v) }
+func (l *recordingLogger) Warnf(format string, v ...interface{})  { l.record(format, v) }
+
+func (l *recordingLogger) record(format string, v []interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestShouldColorLog(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(name string) string { return vars[name] }
+	}
+	noEnv := env(nil)
+
+	assert.True(t, shouldColorLog(LogColorAlways, env(map[string]string{"NO_COLOR": "1"}), false))
+	assert.False(t, shouldColorLog(LogColorNever, env(map[string]string{"FORCE_COLOR": "1"}), true))
+
+	// Auto follows whether output is going to a terminal.
+	assert.True(t, shouldColorLog(LogColorAuto, noEnv, true))
+	assert.False(t, shouldColorLog(LogColorAuto, noEnv, false))
+
+	// Unless overridden by the environment.
+	assert.False(t, shouldColorLog(LogColorAuto, env(map[string]string{"NO_COLOR": "1"}), true))
+	assert.False(t, shouldColorLog(LogColorAuto, env(map[string]string{"TERM": "dumb"}), true))
+	assert.True(t, shouldColorLog(LogColorAuto, env(map[string]string{"FORCE_COLOR": "1"}), false))
+	assert.False(t, shouldColorLog(LogColorAuto, env(map[string]string{"FORCE_COLOR": "0"}), true))
+	assert.False(t, shouldColorLog(LogColorAuto,
+		env(map[string]string{"FORCE_COLOR": "1", "NO_COLOR": "1"}), true))
+}
+
+func TestResolveLogColor(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	noColorEnv := func(name string) string {
+		if name == "NO_COLOR" {
+			return "1"
+		}
+		return ""
+	}
+
+	// The old boolean is still honored, mapping to always.
+	{
+		config := initConfigDefaults(&Config{LogColor: true})
+		assert.True(t, resolveLogColor(config, noColorEnv, false))
+
+		// The configuration isn't changed.
+		assert.True(t, config.LogColor)
+		assert.Equal(t, LogColorMode(""), config.LogColorMode)
+	}
+
+	// But the mode takes precedence.
+	assert.False(t, resolveLogColor(initConfigDefaults(&Config{LogColor: true, LogColorMode: LogColorNever}), noEnv, true))
+
+	// Defaults to auto.
+	{
+		config := initConfigDefaults(&Config{})
+		assert.True(t, resolveLogColor(config, noEnv, true))
+		assert.False(t, resolveLogColor(config, noEnv, false))
+		assert.False(t, resolveLogColor(config, noColorEnv, true))
+		assert.False(t, config.LogColor)
+	}
+
+	// JSON isn't colored in auto mode.
+	assert.False(t, resolveLogColor(initConfigDefaults(&Config{
+		Log: &Logger{Format: LogFormatJSON, Level: LevelInfo},
+	}), noEnv, true))
+}
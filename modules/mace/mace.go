@@ -88,6 +88,8 @@ func RenderFile(c *modulir.Context, basePath, innerPath, target string,
 		return errors.Wrap(err, "Error rendering template")
 	}
 
+	c.RecordWrittenOutput(target)
+
 	c.Log.Debugf("mace: Rendered view '%s' to '%s'", innerPath, target)
 	return nil
 }
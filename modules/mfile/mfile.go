@@ -43,6 +43,8 @@ func CopyFile(c *modulir.Context, source, target string) error {
 		return errors.Wrap(err, "Error copying data")
 	}
 
+	c.RecordWrittenOutput(target)
+
 	c.Log.Debugf("mfile: Copied '%s' to '%s'", source, target)
 	return nil
 }
@@ -96,6 +98,7 @@ func EnsureSymlink(c *modulir.Context, source, target string) error {
 
 	if actual == source {
 		c.Log.Debugf("Link exists.")
+		c.RecordOutput(target)
 		return nil
 	}
 
@@ -122,6 +125,7 @@ create:
 		return errors.Wrap(err, "Error creating symlink")
 	}
 
+	c.RecordWrittenOutput(target)
 	return nil
 }
 
@@ -108,12 +108,24 @@ func FetchAndResizeImage(c *modulir.Context,
 	// for every build.
 	markerPath := sourceNoExt + ".marker"
 
+	ext := strings.ToLower(filepath.Ext(u.Path))
+
+	// Resized images and the marker are left in place when the work is
+	// skipped, so record them as outputs so that they're not pruned.
+	recordSkipped := func() {
+		c.RecordOutput(markerPath)
+		for _, size := range photoSizes {
+			c.RecordOutput(sourceNoExt + size.Suffix + ext)
+		}
+	}
+
 	// We use an in-memory cache to store whether markers exist for some period
 	// of time because going to the filesystem to check every one of them is
 	// relatively slow/expensive.
 	if _, ok := photoMarkerCache.Get(markerPath); ok {
 		c.Log.Debugf("Skipping photo fetch + resize because marker cached: %s",
 			markerPath)
+		recordSkipped()
 		return false, nil
 	}
 
@@ -122,6 +134,7 @@ func FetchAndResizeImage(c *modulir.Context,
 		c.Log.Debugf("Skipping photo fetch + resize because marker exists: %s",
 			markerPath)
 		photoMarkerCache.Set(markerPath, struct{}{}, gocache.DefaultExpiration)
+		recordSkipped()
 		return false, nil
 	}
 
@@ -135,7 +148,6 @@ func FetchAndResizeImage(c *modulir.Context,
 		}
 	}
 
-	ext := strings.ToLower(filepath.Ext(u.Path))
 	originalPath := filepath.Join(tempDir, targetSlug+"_original"+ext)
 	if fullTempDir := path.Dir(originalPath); fullTempDir != path.Clean(tempDir) {
 		err := mfile.EnsureDir(c, fullTempDir)
@@ -165,6 +177,8 @@ func FetchAndResizeImage(c *modulir.Context,
 	}
 	file.Close()
 
+	c.RecordWrittenOutput(markerPath)
+
 	return true, nil
 }
 
@@ -369,5 +383,7 @@ func resizeImage(c *modulir.Context,
 		}
 	}
 
+	c.RecordWrittenOutput(target)
+
 	return nil
 }
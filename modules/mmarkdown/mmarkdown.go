@@ -39,6 +39,8 @@ func RenderFile(c *modulir.Context, source, target string) error {
 		return errors.Wrap(err, "Error writing file")
 	}
 
+	c.RecordWrittenOutput(target)
+
 	c.Log.Debugf("mmarkdown: Rendered '%s' to '%s'", source, target)
 	return nil
 }
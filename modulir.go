@@ -3,7 +3,6 @@ package modulir
 import (
 	"context"
 	"fmt"
-	"net/http"
 	"os"
 	"os/signal"
 	"sync"
@@ -26,29 +25,201 @@ import (
 
 // Config contains configuration.
 type Config struct {
+	// AbortOnChange causes a build that's in progress to be aborted when new
+	// changes are detected by the watcher. Jobs that haven't started are
+	// dropped and running jobs added with Context.AddJobWithContext have
+	// their context canceled. A new build starts as soon as the aborted one
+	// winds down, covering changes seen by both. This applies to every build
+	// in the loop, including the initial one and forced rebuilds.
+	//
+	// Defaults to false, where new changes are built only after the current
+	// build finishes.
+	AbortOnChange bool
+
+	// CacheFile is a path to a file where Modulir persists what it knows
+	// about source files between runs so that after a restart, Changed
+	// only reports files that were modified since the last successful build.
+	// It may live in TargetDir or somewhere else like a cache directory. A
+	// cache file that's corrupt, from an incompatible version, stale, or
+	// written with a different CacheKey is discarded in favor of a full
+	// build.
+	//
+	// Defaults to not persisting anything, with every run starting with a full
+	// build.
+	CacheFile string
+
+	// CacheKey identifies anything that affects the build beyond its source
+	// files, like the version of its templates or logic. A cache file
+	// written with a different key is discarded in favor of a full build, so
+	// it should be changed whenever existing output can't be trusted
+	// anymore.
+	//
+	// Defaults to an empty key, with the cache file kept across changes to
+	// the program.
+	CacheKey string
+
+	// ChangeDetection is the strategy used by Context.Changed to decide
+	// whether a file has changed. See the ChangeDetection constants for
+	// the tradeoffs of each.
+	//
+	// Defaults to ChangeDetectionModTime.
+	ChangeDetection ChangeDetection
+
 	// Concurrency is the number of concurrent workers to run during the build
 	// step.
 	//
 	// Defaults to 10.
 	Concurrency int
 
-	// Log specifies a logger to use.
+	// JobTimeout is a hard timeout applied to every job that doesn't set its
+	// own with JobOptions. Jobs that exceed it fail with a JobTimeoutError,
+	// and jobs added with Context.AddJobWithContext have their context
+	// canceled.
+	//
+	// Defaults to no timeout.
+	JobTimeout time.Duration
+
+	// Log specifies a logger to use. Loggers that implement
+	// StructuredLoggerInterface (like Logger, or SlogLogger to use
+	// `log/slog`) receive context like job names as fields.
 	//
 	// Defaults to an instance of Logger running at informational level.
 	Log LoggerInterface
 
-	// LogColor specifies whether messages sent to Log should be color. You may
-	// want to set to true if you know output is going to a terminal.
+	// LogColor specifies that messages sent to Log should be colored. It's
+	// kept for compatibility, and if LogColorMode isn't set, true maps to
+	// LogColorAlways, which colors messages even if NO_COLOR is set.
 	//
 	// Defaults to false.
 	LogColor bool
 
+	// LogColorMode specifies whether messages sent to Log should be colored.
+	// See the LogColorMode constants.
+	//
+	// Defaults to LogColorAuto, where messages are colored when stdout and
+	// stderr are terminals, honoring the NO_COLOR and FORCE_COLOR environment
+	// variables.
+	LogColorMode LogColorMode
+
 	// Port specifies the port on which to serve content from TargetDir over
 	// HTTP.
 	//
 	// Defaults to not running if left unset.
 	Port int
 
+	// Progress enables a display of the progress of each build while it
+	// runs, including how many jobs have finished, the jobs that each worker
+	// is running, and an estimate of the time remaining. It's redrawn in
+	// place on stderr when that's a terminal, and otherwise a line of
+	// progress is logged every few seconds.
+	//
+	// Defaults to false.
+	Progress bool
+
+	// PruneOutputs enables a pass at the end of each successful full build
+	// that deletes files in TargetDir that were recorded as outputs by a
+	// previous build (see Context.RecordOutput), but not by the current one.
+	// A manifest of outputs is kept for this purpose next to CacheFile, or
+	// in the user's cache directory if CacheFile isn't set.
+	//
+	// A build is full if it did all of its work: Context.Changed never
+	// reported a file as unchanged, and every job that was skipped declared
+	// its Job.Outputs. Other builds can't tell orphans from outputs that
+	// just weren't recorded, so they only add to the manifest. That
+	// includes most builds after the first when CacheFile is set, unless
+	// jobs declare their inputs and outputs instead of calling Changed, or
+	// a full rebuild is forced from the dashboard.
+	//
+	// Only files that Modulir recorded are ever considered, so files placed in
+	// TargetDir by other means are left alone.
+	//
+	// Defaults to false.
+	PruneOutputs bool
+
+	// PruneOutputsAllowlist is a set of patterns in the style of
+	// filepath.Match for paths relative to TargetDir that should never be
+	// pruned. A pattern matching a directory also protects everything in it.
+	PruneOutputsAllowlist []string
+
+	// PruneOutputsDryRun causes orphaned outputs found with PruneOutputs to
+	// be logged instead of deleted.
+	//
+	// Defaults to false.
+	PruneOutputsDryRun bool
+
+	// ReportPath is a path to which a JSON report on each build is written,
+	// including the timing and result of every job along with totals. It's
+	// useful for tracking build performance over time, like in CI.
+	//
+	// Defaults to not writing a report.
+	ReportPath string
+
+	// ResourceClasses maps the names of resource classes to the maximum
+	// number of jobs of each class that may run at once, like:
+	//
+	//     map[string]int{
+	//         "cpu-heavy": runtime.NumCPU(),
+	//         "network":   4,
+	//     }
+	//
+	// Jobs are assigned a class with JobOptions. Those without one, or whose
+	// class isn't present here, are only limited by Concurrency.
+	ResourceClasses map[string]int
+
+	// ServeContentTypes maps patterns of paths relative to TargetDir to the
+	// content types that the development server should serve them with,
+	// overriding detection by extension and sniffing, like:
+	//
+	//     map[string]string{
+	//         "articles/*": "text/html; charset=utf-8",
+	//         "*.atom":     "application/atom+xml",
+	//     }
+	//
+	// Patterns use path.Match syntax. Ones without a slash match only the
+	// base name of a path, and if several match, the longest wins.
+	//
+	// Defaults to detecting content types.
+	ServeContentTypes map[string]string
+
+	// ServeNotFoundPage is a path relative to TargetDir of a page to serve
+	// with a 404 status when the development server can't find what was
+	// requested, like "404.html".
+	//
+	// Defaults to a plain text response.
+	ServeNotFoundPage string
+
+	// ServePrecompressed causes the development server to serve a
+	// precompressed sibling of a file, like "index.html.br" or
+	// "index.html.gz", with the appropriate Content-Encoding when the
+	// client's Accept-Encoding allows it. Brotli is preferred over gzip. Note
+	// that live reload can't be injected into compressed pages.
+	//
+	// Defaults to false.
+	ServePrecompressed bool
+
+	// ServePrettyURLs causes the development server to serve paths like
+	// "/about" from "about.html" when nothing exists at the path itself, the
+	// way that many static hosts do. "about/index.html" is always served for
+	// "/about/".
+	//
+	// Defaults to false.
+	ServePrettyURLs bool
+
+	// ServeRedirectsFile is a path to a file of redirect and rewrite rules
+	// in the style of Netlify's `_redirects` that the development server
+	// applies, like "public/_redirects". Rules are one per line with a source
+	// path, a target, and an optional status:
+	//
+	//     /blog/*     /articles/:splat  301
+	//     /app/*      /app/index.html   200
+	//
+	// The file is reread on every request, so it may be produced by the
+	// build. A rule only applies to paths where no file exists unless its
+	// status is suffixed with "!".
+	//
+	// Defaults to not applying any rules.
+	ServeRedirectsFile string
+
 	// SourceDir is the directory containing source files.
 	//
 	// Defaults to ".".
@@ -59,68 +230,163 @@ type Config struct {
 	// Defaults to "./public".
 	TargetDir string
 
+	// TracePath is a path to which a timeline of each build is written in the
+	// Chrome Trace Event format, showing which worker ran each job and when
+	// along with round boundaries. It can be opened with chrome://tracing or
+	// Perfetto to see where parallelism is lost.
+	//
+	// Defaults to not writing a trace.
+	TracePath string
+
 	// Websocket indicates that Modulir should be started in development
-	// mode with a websocket that provides features like live reload.
+	// mode with a websocket that provides features like live reload. The
+	// script that connects to it is injected into HTML pages as they're
+	// served, so there's no need to include it in layouts.
 	//
 	// Defaults to false.
 	Websocket bool
+
+	// WebsocketURL is the URL that pages should connect to for the
+	// websocket, like "wss://example.ngrok.io/websocket". It's only needed
+	// when the default, which is derived from the URL that the websocket
+	// script was loaded from, isn't reachable from the browser.
+	//
+	// Defaults to empty.
+	WebsocketURL string
 }
 
 // Build is one of the main entry points to the program. Call this to build
 // only one time.
+//
+// It exits the process with a non-zero status if the build fails. Use a
+// Builder instead to handle failures some other way.
 func Build(config *Config, f func(*Context) []error) {
-	var buildCompleteMu sync.Mutex
-	buildComplete := sync.NewCond(&buildCompleteMu)
-	finish := make(chan struct{}, 1)
-
-	// Signal the build loop to finish immediately
-	finish <- struct{}{}
-
-	c := initContext(config, nil)
-	ensureTargetDir(c)
-
-	success := build(c, f, finish, buildComplete)
-	if !success {
-		os.Exit(1)
+	err := NewBuilder(config, f).Run(context.Background())
+	if err != nil {
+		// The errors of a failed build have already been logged.
+		if _, ok := err.(*BuildError); ok {
+			os.Exit(1)
+		}
+		exitWithError(err)
 	}
 }
 
 // BuildLoop is one of the main entry points to the program. Call this to build
 // in a perpetual loop.
+//
+// It never returns. Use a Builder instead to control when building stops.
 func BuildLoop(config *Config, f func(*Context) []error) {
-	var buildCompleteMu sync.Mutex
-	buildComplete := sync.NewCond(&buildCompleteMu)
-	finish := make(chan struct{}, 1)
+	if err := buildLoop(context.Background(), config, f); err != nil {
+		exitWithError(err)
+	}
+}
+
+// BuildError is returned by Builder.Run when a build fails. Its errors will
+// already have been logged.
+type BuildError struct {
+	// Errors are the errors returned from the build function along with
+	// those of any jobs it didn't wait on.
+	Errors []error
+}
 
+// Error returns the error message.
+func (e *BuildError) Error() string {
+	return fmt.Sprintf("Build failed with %v error(s)", len(e.Errors))
+}
+
+// Builder builds a site with a build function. Unlike Build and BuildLoop,
+// it returns errors instead of exiting the process and stops when its
+// context is canceled, so it can be embedded in a larger program or driven
+// from tests.
+type Builder struct {
+	config *Config
+	f      func(*Context) []error
+}
+
+// NewBuilder initializes and returns a new Builder. Defaults are filled in
+// for any properties of the configuration that weren't set.
+func NewBuilder(config *Config, f func(*Context) []error) *Builder {
+	return &Builder{
+		config: initConfigDefaults(config),
+		f:      f,
+	}
+}
+
+// Run builds the site one time. If the build fails, a *BuildError is
+// returned.
+//
+// If ctx is canceled partway through, jobs that haven't started are dropped,
+// running jobs added with Context.AddJobWithContext have their context
+// canceled, and the context's error is returned.
+func (b *Builder) Run(ctx context.Context) error {
+	_, err := b.run(ctx)
+	return err
+}
+
+// Serve builds the site, then watches for changes and rebuilds in a loop
+// while serving it over HTTP on the configured port. Failed builds are
+// logged rather than returned because a fix is expected to follow.
+//
+// It blocks until ctx is canceled, after which it cancels any build in
+// progress, shuts down the watcher and HTTP server gracefully, and returns
+// nil. An error is returned if anything goes wrong starting up or serving.
+func (b *Builder) Serve(ctx context.Context) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		exitWithError(errors.Wrap(err, "Error starting watcher"))
+		return errors.Wrap(err, "Error starting watcher")
 	}
 	defer watcher.Close()
 
-	c := initContext(config, watcher)
-	ensureTargetDir(c)
+	c := initContext(b.config, watcher)
+	if err := ensureTargetDir(c); err != nil {
+		return err
+	}
+	loadFileCache(c)
+
+	buildComplete := sync.NewCond(&sync.Mutex{})
+	finish := make(chan struct{}, 1)
+
+	// Serving starts before the first build so that the site is reachable
+	// right away.
+	server, serveErrs, err := startServingTargetDirHTTP(ctx, c, buildComplete)
+	if err != nil {
+		return err
+	}
+
+	// Canceled on shutdown to cancel any build in progress.
+	buildCtx, cancelBuild := context.WithCancel(ctx)
+	defer cancelBuild()
 
-	// Serve HTTP
-	var server *http.Server
+	// Run the build loop. Loops until receiving on finish.
+	buildDone := make(chan struct{})
 	go func() {
-		server = startServingTargetDirHTTP(c, buildComplete)
+		build(buildCtx, c, b.f, finish, buildComplete)
+		close(buildDone)
 	}()
 
-	// Run the build loop. Loops forever until receiving on finish.
-	go build(c, f, finish, buildComplete)
+	var serveErr error
+	select {
+	case <-ctx.Done():
+	case serveErr = <-serveErrs:
+	}
 
-	// Listen for signals. Modulir will gracefully exit and re-exec itself upon
-	// receipt of USR2.
-	signals := make(chan os.Signal, 1024)
-	signal.Notify(signals, unix.SIGUSR2)
-	for {
-		s := <-signals
-		switch s {
-		case unix.SIGUSR2:
-			shutdownAndExec(c, finish, watcher, server)
-		}
+	// Tell the build loop to finish up, canceling any jobs that are still
+	// running.
+	cancelBuild()
+	finish <- struct{}{}
+	<-buildDone
+
+	// A context that will act as a timeout for connections that are still
+	// running as we try and shut down the HTTP server.
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c.Log.Infof("Shutting down HTTP server")
+	if err := server.Shutdown(timeoutCtx); err != nil && serveErr == nil {
+		serveErr = errors.Wrap(err, "Error shutting down HTTP server")
 	}
+
+	return serveErr
 }
 
 //////////////////////////////////////////////////////////////////////////////
@@ -134,18 +400,25 @@ func BuildLoop(config *Config, f func(*Context) []error) {
 //////////////////////////////////////////////////////////////////////////////
 
 // Runs an infinite built loop until a signal is received over the `finish`
-// channel.
+// channel. Canceling ctx cancels the build in progress along with any that
+// follow.
 //
-// Returns true of the last build was successful and false otherwise.
-func build(c *Context, f func(*Context) []error,
-	finish chan struct{}, buildComplete *sync.Cond) bool {
+// Returns the errors of the last build, which are empty if it was
+// successful.
+func build(ctx context.Context, c *Context, f func(*Context) []error,
+	finish chan struct{}, buildComplete *sync.Cond) []error {
 
-	rebuild := make(chan map[string]struct{})
+	rebuild := make(chan *rebuildRequest)
 	rebuildDone := make(chan struct{})
 
+	// Closed when the loop returns so that the watcher doesn't get stuck
+	// trying to start a rebuild that will never happen.
+	stop := make(chan struct{})
+	defer close(stop)
+
 	if c.Watcher != nil {
-		go watchChanges(c, c.Watcher.Events, c.Watcher.Errors,
-			rebuild, rebuildDone)
+		go watchChanges(ctx, c, c.Watcher.Events, c.Watcher.Errors,
+			rebuild, rebuildDone, stop)
 	}
 
 	// Paths that changed on the last loop (as discovered via fsnotify). If
@@ -154,10 +427,39 @@ func build(c *Context, f func(*Context) []error,
 	// filesystem and makes jobs much faster to run.
 	var lastChangedSources map[string]struct{}
 
+	// Whether the current build was requested by the watcher, which waits to
+	// hear that it's done.
+	var fromWatcher bool
+
+	// The context that the current build's context is derived from. For a
+	// build requested by the watcher, it's the context that the watcher
+	// cancels to abort it.
+	buildParent := ctx
+
+	// Whether the current build is a forced rebuild requested from the
+	// dashboard, and the value of Forced to restore once it's done.
+	var forceRebuild, wasForced bool
+
 	for {
 		c.Log.Debugf("Start loop")
+
+		// Each build gets its own context so that canceling it can't be
+		// undone by the reset of a later build.
+		buildCtx, cancelBuild := context.WithCancel(buildParent)
+		c.buildCtx = buildCtx
+
 		c.ResetBuild()
 		c.StartRound()
+		c.status.startBuild(c.Stats.Start, cancelBuild)
+
+		if c.progress != nil {
+			c.progress.start(c.Stats.Start)
+		}
+
+		if forceRebuild {
+			wasForced = c.Forced
+			c.Forced = true
+		}
 
 		if lastChangedSources != nil {
 			c.QuickPaths = lastChangedSources
@@ -177,53 +479,212 @@ func build(c *Context, f func(*Context) []error,
 		// shut it back down.
 		c.Pool.Wait()
 
+		// Clear the progress display before the build's results are logged.
+		if c.progress != nil {
+			c.progress.finish()
+		}
+
+		// Any jobs in that last round weren't seen by the context, so make
+		// sure that their outputs are still recorded.
+		c.recordJobOutputs(c.Pool.JobsAll)
+
 		buildDuration := time.Now().Sub(c.Stats.Start)
 
 		if lastRoundErrors != nil {
 			errors = append(errors, lastRoundErrors...)
 		}
 
-		c.Pool.LogErrorsSlice(errors)
-		c.Pool.LogSlowestSlice(c.Stats.JobsExecuted)
-
-		success := len(c.Stats.JobsErrored) == 0
-
-		c.Log.Infof(
-			c.colorizer.Bold(colorByStatus(c, "Built site in %s", success)).String()+
-				" (loop took %v; total non-parallel time %v)",
-			buildDuration.Truncate(100*time.Microsecond),
-			c.Stats.LoopDuration.Truncate(100*time.Microsecond),
-			calculateTotalDuration(c.Stats.JobsExecuted).Truncate(100*time.Microsecond),
-		)
-		c.Log.Infof(
-			"%v of %v job(s) did work in %v round(s); "+
-				c.colorizer.Bold(colorByStatus(c, "%v errored", success)).String(),
-			len(c.Stats.JobsExecuted), c.Stats.NumJobs, c.Stats.NumRounds, len(c.Stats.JobsErrored),
-		)
+		// The build was canceled partway through, most likely because new
+		// changes came in while it was running (see AbortOnChange). Its
+		// results are incomplete, so don't report on them, and forget about
+		// the files that it saw so that the next build considers them again.
+		aborted := c.Pool.Canceled()
+
+		// An aborted build's changes are carried into the next one. A nil set
+		// means that it wasn't a quick build, so the next one won't be either.
+		var abortedSources map[string]struct{}
+
+		if aborted {
+			c.fileModTimeCache.discard()
+			c.status.finishBuild(nil)
+			abortedSources = lastChangedSources
+
+			c.Log.Infof(
+				c.colorizer.Bold(c.colorizer.Yellow("Aborted build after %s")).String(),
+				buildDuration.Truncate(100*time.Microsecond),
+			)
+		} else {
+			// Jobs in the last round are only on the pool if the context
+			// never waited on them.
+			jobs := append(append([]*Job(nil), c.Stats.JobsAll...), c.Pool.JobsAll...)
+
+			c.Pool.LogErrorsSlice(errors)
+			c.Pool.LogSlowestSlice(c.Stats.JobsExecuted)
+
+			success := len(c.Stats.JobsErrored) == 0
+
+			// Only persist the cache after a fully successful build. Otherwise
+			// the files of jobs that failed would look unchanged after a restart
+			// and the jobs would never be retried.
+			if success && len(errors) < 1 {
+				if err := saveFileCache(c); err != nil {
+					c.Log.Errorf("Error saving cache file: %v", err)
+				}
+
+				// Similarly, pruning after a failure could delete outputs that
+				// only went unrecorded because their jobs failed.
+				if c.PruneOutputs {
+					if err := pruneOutputs(c, c.fullBuild(jobs)); err != nil {
+						c.Log.Errorf("Error pruning outputs: %v", err)
+					}
+				}
+			}
+
+			c.Log.Infof(
+				c.colorizer.Bold(colorByStatus(c, "Built site in %s", success)).String()+
+					" (loop took %v; total non-parallel time %v)",
+				buildDuration.Truncate(100*time.Microsecond),
+				c.Stats.LoopDuration.Truncate(100*time.Microsecond),
+				calculateTotalDuration(c.Stats.JobsExecuted).Truncate(100*time.Microsecond),
+			)
+			c.Log.Infof(
+				"%v of %v job(s) did work in %v round(s); "+
+					c.colorizer.Bold(colorByStatus(c, "%v errored", success)).String(),
+				len(c.Stats.JobsExecuted), c.Stats.NumJobs, c.Stats.NumRounds, len(c.Stats.JobsErrored),
+			)
+
+			if len(c.Stats.JobsRetried) > 0 {
+				c.Log.Infof("%v job(s) needed retries", len(c.Stats.JobsRetried))
+			}
+
+			report := newBuildReport(c, jobs, errors, buildDuration)
+			c.status.finishBuild(report)
+
+			if c.ReportPath != "" {
+				if err := writeBuildReport(c, report); err != nil {
+					c.Log.Errorf("Error writing build report: %v", err)
+				}
+			}
+
+			if c.TracePath != "" {
+				trace := newChromeTrace(c, jobs, buildDuration)
+				if err := writeChromeTrace(c, trace); err != nil {
+					c.Log.Errorf("Error writing trace: %v", err)
+				}
+			}
+		}
 
 		lastChangedSources = nil
 		c.QuickPaths = nil
 
-		buildComplete.Broadcast()
+		if !aborted {
+			buildComplete.Broadcast()
+		}
 
-		if c.FirstRun {
-			c.FirstRun = false
-		} else {
+		if forceRebuild {
+			c.Forced = wasForced
+			forceRebuild = false
+		}
+
+		c.FirstRun = false
+
+		cancelBuild()
+
+		if fromWatcher {
 			rebuildDone <- struct{}{}
 		}
 
 		select {
 		case <-finish:
 			c.Log.Infof("Build loop detected finish signal; stopping")
-			return len(errors) < 1
+			return errors
 
-		case lastChangedSources = <-rebuild:
+		case request := <-rebuild:
 			c.Log.Infof("Build loop detected change on %v; rebuilding",
-				mapKeys(lastChangedSources))
+				mapKeys(request.sources))
+			buildParent = request.ctx
+			fromWatcher = true
+			lastChangedSources = request.sources
+
+			if aborted {
+				if abortedSources == nil {
+					lastChangedSources = nil
+				} else {
+					for path := range abortedSources {
+						lastChangedSources[path] = struct{}{}
+					}
+				}
+			}
+
+		case <-c.forceRebuild:
+			c.Log.Infof("Build loop received request for forced rebuild; rebuilding")
+			buildParent = ctx
+			forceRebuild = true
+			fromWatcher = false
+			lastChangedSources = nil
 		}
 	}
 }
 
+// Builds the site one time like Builder.Run, but also returns the context
+// that was used for the build so that its results can be inspected.
+func (b *Builder) run(ctx context.Context) (*Context, error) {
+	c := initContext(b.config, nil)
+	if err := ensureTargetDir(c); err != nil {
+		return nil, err
+	}
+	loadFileCache(c)
+
+	// Signal the build loop to finish immediately
+	finish := make(chan struct{}, 1)
+	finish <- struct{}{}
+
+	errs := build(ctx, c, b.f, finish, sync.NewCond(&sync.Mutex{}))
+
+	if ctx.Err() != nil {
+		return c, ctx.Err()
+	}
+
+	if len(errs) > 0 {
+		return c, &BuildError{Errors: errs}
+	}
+
+	return c, nil
+}
+
+// Builds and serves the site like Builder.Serve until ctx is canceled, except
+// that upon receipt of USR2, Modulir will gracefully shut down and re-exec
+// itself.
+func buildLoop(ctx context.Context, config *Config, f func(*Context) []error) error {
+	builder := NewBuilder(config, f)
+
+	serveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- builder.Serve(serveCtx)
+	}()
+
+	signals := make(chan os.Signal, 1024)
+	signal.Notify(signals, unix.SIGUSR2)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-serveErr:
+		return err
+
+	case <-signals:
+		cancel()
+		if err := <-serveErr; err != nil {
+			return err
+		}
+		execSelf(builder.config.Log)
+	}
+
+	return nil
+}
+
 func colorByStatus(c *Context, s string, success bool) string {
 	if success {
 		return c.colorizer.Green(s).String()
@@ -244,10 +705,11 @@ func calculateTotalDuration(jobs []*Job) time.Duration {
 // Ensures that the configured TargetDir exists. We want to do this early (i.e.
 // before the build loop) so that we can start the HTTP server right away
 // instead of waiting for a build.
-func ensureTargetDir(c *Context) {
+func ensureTargetDir(c *Context) error {
 	if err := os.MkdirAll(c.TargetDir, 0755); err != nil {
-		exitWithError(fmt.Errorf("Error creating target directory: %v", err))
+		return fmt.Errorf("Error creating target directory: %v", err)
 	}
+	return nil
 }
 
 // Exits with status 1 after printing the given error to stderr.
@@ -263,6 +725,10 @@ func initConfigDefaults(config *Config) *Config {
 		config = &Config{}
 	}
 
+	if config.ChangeDetection == "" {
+		config.ChangeDetection = ChangeDetectionModTime
+	}
+
 	if config.Concurrency <= 0 {
 		config.Concurrency = 50
 	}
@@ -282,19 +748,73 @@ func initConfigDefaults(config *Config) *Config {
 	return config
 }
 
+// Returns the color mode of a configuration, taking LogColor into account if
+// LogColorMode isn't set.
+func configLogColorMode(config *Config) LogColorMode {
+	if config.LogColorMode != "" {
+		return config.LogColorMode
+	}
+
+	if config.LogColor {
+		return LogColorAlways
+	}
+
+	return LogColorAuto
+}
+
+// Decides whether log messages should be colored according to a
+// configuration and the environment. It's resolved when a context is
+// initialized rather than stored back to the configuration so that the
+// configuration always reflects what the caller asked for.
+func resolveLogColor(config *Config, getenv func(string) string, terminal bool) bool {
+	mode := configLogColorMode(config)
+
+	// JSON is meant for machines, which don't want escape sequences.
+	if logger, ok := config.Log.(*Logger); ok && logger.Format == LogFormatJSON &&
+		mode == LogColorAuto {
+
+		return false
+	}
+
+	return shouldColorLog(mode, getenv, terminal)
+}
+
 // Initializes a new Modulir context from the given configuration.
 func initContext(config *Config, watcher *fsnotify.Watcher) *Context {
 	config = initConfigDefaults(config)
 
+	logColor := resolveLogColor(config, os.Getenv,
+		isTerminal(os.Stdout) && isTerminal(os.Stderr))
+
+	pool := NewPool(config.Log, config.Concurrency)
+	pool.JobTimeout = config.JobTimeout
+	pool.ResourceClasses = config.ResourceClasses
+
 	return NewContext(&Args{
-		Log:       config.Log,
-		LogColor:  config.LogColor,
-		Port:      config.Port,
-		Pool:      NewPool(config.Log, config.Concurrency),
-		SourceDir: config.SourceDir,
-		TargetDir: config.TargetDir,
-		Watcher:   watcher,
-		Websocket: config.Websocket,
+		AbortOnChange:         config.AbortOnChange,
+		CacheFile:             config.CacheFile,
+		CacheKey:              config.CacheKey,
+		ChangeDetection:       config.ChangeDetection,
+		Log:                   config.Log,
+		LogColor:              logColor,
+		Port:                  config.Port,
+		Progress:              config.Progress,
+		PruneOutputs:          config.PruneOutputs,
+		PruneOutputsAllowlist: config.PruneOutputsAllowlist,
+		PruneOutputsDryRun:    config.PruneOutputsDryRun,
+		Pool:                  pool,
+		ReportPath:            config.ReportPath,
+		ServeContentTypes:     config.ServeContentTypes,
+		ServeNotFoundPage:     config.ServeNotFoundPage,
+		ServePrecompressed:    config.ServePrecompressed,
+		ServePrettyURLs:       config.ServePrettyURLs,
+		ServeRedirectsFile:    config.ServeRedirectsFile,
+		SourceDir:             config.SourceDir,
+		TargetDir:             config.TargetDir,
+		TracePath:             config.TracePath,
+		Watcher:               watcher,
+		Websocket:             config.Websocket,
+		WebsocketURL:          config.WebsocketURL,
 	})
 }
 
@@ -312,41 +832,16 @@ func mapKeys(m map[string]struct{}) []string {
 // USR2 signal and is intended to allow the process to refresh itself in the
 // case where it's source files changed and it was recompiled.
 //
-// The fsnotify watcher and HTTP server are shut down as gracefully as possible
+// The build loop, fsnotify watcher, and HTTP server should be shut down
 // before the replacement occurs.
-func shutdownAndExec(c *Context, finish chan struct{},
-	watcher *fsnotify.Watcher, server *http.Server) {
-
-	// Tell the build loop to finish up
-	finish <- struct{}{}
-
-	// DANGER: Defers don't seem to get called on the re-exec, so even though
-	// we have a defer which closes our watcher, it won't close, leading to
-	// file descriptor leaking. Close it manually here instead.
-	watcher.Close()
-
-	// A context that will act as a timeout for connections
-	// that are still running as we try and shut down the HTTP
-	// server.
-	timeoutCtx, cancel := context.WithTimeout(
-		context.Background(),
-		5*time.Second,
-	)
-
-	c.Log.Infof("Shutting down HTTP server")
-	if err := server.Shutdown(timeoutCtx); err != nil {
-		exitWithError(err)
-	}
-
-	cancel()
-
+func execSelf(log LoggerInterface) {
 	// Returns an absolute path.
 	execPath, err := os.Executable()
 	if err != nil {
 		exitWithError(err)
 	}
 
-	c.Log.Infof("Execing process '%s' with args %+v\n", execPath, os.Args)
+	log.Infof("Execing process '%s' with args %+v\n", execPath, os.Args)
 	if err := unix.Exec(execPath, os.Args, os.Environ()); err != nil {
 		exitWithError(err)
 	}
@@ -1,7 +1,130 @@
 package modulir
 
 import (
-//"testing"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
 
-//assert "github.com/stretchr/testify/require"
+	assert "github.com/stretchr/testify/require"
 )
+
+func TestBuilderRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := &Config{
+		Log:       &Logger{Level: LevelWarn},
+		SourceDir: dir,
+		TargetDir: filepath.Join(dir, "public"),
+	}
+
+	// Success
+	{
+		err := NewBuilder(config, func(c *Context) []error {
+			c.AddJob("job", func() (bool, error) { return true, nil })
+			return c.Wait()
+		}).Run(context.Background())
+		assert.NoError(t, err)
+
+		// The target directory is created.
+		_, err = os.Stat(config.TargetDir)
+		assert.NoError(t, err)
+	}
+
+	// Failure
+	{
+		err := NewBuilder(config, func(c *Context) []error {
+			c.AddJob("job", func() (bool, error) { return true, fmt.Errorf("error") })
+			return c.Wait()
+		}).Run(context.Background())
+		assert.EqualError(t, err, "Build failed with 1 error(s)")
+
+		buildErr, ok := err.(*BuildError)
+		assert.True(t, ok)
+		assert.Equal(t, 1, len(buildErr.Errors))
+	}
+
+	// Canceled
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+
+		err := NewBuilder(config, func(c *Context) []error {
+			c.AddJobWithContext("job", func(ctx context.Context) (bool, error) {
+				cancel()
+				<-ctx.Done()
+				return true, ctx.Err()
+			}, nil)
+			return c.Wait()
+		}).Run(ctx)
+		assert.Equal(t, context.Canceled, err)
+	}
+
+	// Canceled before starting
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		// Repeated because a cancellation from before the build started
+		// used to be lost only some of the time.
+		for i := 0; i < 100; i++ {
+			var ran bool
+			err := NewBuilder(config, func(c *Context) []error {
+				c.AddJob("job", func() (bool, error) {
+					ran = true
+					return true, nil
+				})
+				return c.Wait()
+			}).Run(ctx)
+			assert.Equal(t, context.Canceled, err)
+			assert.False(t, ran)
+		}
+	}
+}
+
+func TestBuilderServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	built := make(chan struct{}, 1)
+
+	builder := NewBuilder(&Config{
+		Log:       &Logger{Level: LevelWarn},
+		SourceDir: dir,
+		TargetDir: filepath.Join(dir, "public"),
+	}, func(c *Context) []error {
+		select {
+		case built <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- builder.Serve(ctx)
+	}()
+
+	select {
+	case <-built:
+	case err := <-serveErr:
+		assert.FailNow(t, "Serve returned early", "%v", err)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "Timed out waiting for build")
+	}
+
+	cancel()
+
+	select {
+	case err := <-serveErr:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "Timed out waiting for Serve to return")
+	}
+}
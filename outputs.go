@@ -0,0 +1,230 @@
+package modulir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Version of the outputs manifest format. Bump this whenever the format
+// changes in a way that's incompatible with older versions.
+const outputsManifestVersion = 1
+
+// Suffix appended to the path of the cache file to get the path of the
+// outputs manifest.
+const outputsManifestSuffix = ".outputs.json"
+
+// The format of the outputs manifest that's persisted to disk.
+type outputsManifest struct {
+	// Version is the version of the format that the manifest was written
+	// with.
+	Version int `json:"version"`
+
+	// Outputs are the paths of every output that was recorded, relative to
+	// TargetDir.
+	Outputs []string `json:"outputs"`
+}
+
+// Deletes outputs recorded by previous builds that weren't recorded by the
+// one that just finished, then saves the outputs of this build for next time.
+//
+// Orphans are only pruned after a full build (see Context.fullBuild) because
+// builds that skip work don't record every output. After one of those, newly
+// recorded outputs are merged into the manifest instead.
+func pruneOutputs(c *Context, fullBuild bool) error {
+	manifestPath, err := outputsManifestPath(c.CacheFile, c.TargetDir)
+	if err != nil {
+		return err
+	}
+
+	previous, err := readOutputsManifest(manifestPath)
+	if err != nil {
+		c.Log.Warnf("Discarding outputs manifest '%s': %v", manifestPath, err)
+		previous = nil
+	}
+
+	recorded := c.recordedOutputs()
+
+	if !fullBuild {
+		for _, output := range previous {
+			recorded[output] = struct{}{}
+		}
+		return writeOutputsManifest(manifestPath, recorded)
+	}
+
+	var numPruned int
+	for _, output := range previous {
+		if _, ok := recorded[output]; ok {
+			continue
+		}
+
+		if outputAllowed(c.PruneOutputsAllowlist, output) {
+			c.Log.Debugf("Not pruning allowlisted output: %s", output)
+			continue
+		}
+
+		path := filepath.Join(c.TargetDir, output)
+
+		if c.PruneOutputsDryRun {
+			c.Log.Infof("Would prune orphaned output: %s", path)
+
+			// Keep it in the manifest so that it's reported again next time.
+			recorded[output] = struct{}{}
+			continue
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			c.Log.Errorf("Error pruning orphaned output: %v", err)
+			recorded[output] = struct{}{}
+			continue
+		}
+
+		c.Log.Infof("Pruned orphaned output: %s", path)
+		removeEmptyParents(c.TargetDir, path)
+		numPruned++
+	}
+
+	if numPruned > 0 {
+		c.Log.Infof("Pruned %v orphaned output(s)", numPruned)
+	}
+
+	return writeOutputsManifest(manifestPath, recorded)
+}
+
+// Checks whether a path relative to TargetDir is matched by one of the
+// patterns in the given allowlist. Patterns use filepath.Match syntax, and a
+// pattern that matches a directory also matches everything beneath it.
+func outputAllowed(allowlist []string, output string) bool {
+	for _, pattern := range allowlist {
+		pattern = filepath.Clean(pattern)
+
+		for path := output; path != "." && path != string(filepath.Separator); path = filepath.Dir(path) {
+			if ok, _ := filepath.Match(pattern, path); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns the path of the outputs manifest. It's kept next to the cache file
+// if there is one, and otherwise in the user's cache directory under a name
+// derived from the target directory. Either way it's outside the target
+// directory (unless the cache file was put there) so that it's not served or
+// deployed along with the site.
+func outputsManifestPath(cacheFile, targetDir string) (string, error) {
+	if cacheFile != "" {
+		return cacheFile + outputsManifestSuffix, nil
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", errors.Wrap(err, "Error finding cache directory for outputs manifest")
+	}
+
+	absTargetDir, err := filepath.Abs(targetDir)
+	if err != nil {
+		return "", errors.Wrap(err, "Error resolving target directory")
+	}
+
+	sum := sha256.Sum256([]byte(absTargetDir))
+	return filepath.Join(cacheDir, "modulir", "outputs-"+hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// Reads the outputs manifest at the given path. Returns nil without an error
+// if it doesn't exist.
+func readOutputsManifest(path string) ([]string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading outputs manifest")
+	}
+
+	var manifest outputsManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, errors.Wrap(err, "Outputs manifest is corrupt")
+	}
+
+	if manifest.Version != outputsManifestVersion {
+		return nil, fmt.Errorf("Outputs manifest version is %v, but expected %v",
+			manifest.Version, outputsManifestVersion)
+	}
+
+	return manifest.Outputs, nil
+}
+
+// Removes directories between the given path and targetDir for as long as
+// they're empty.
+func removeEmptyParents(targetDir, path string) {
+	targetDir = filepath.Clean(targetDir)
+
+	for dir := filepath.Dir(path); dir != targetDir && dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		// Fails if the directory isn't empty, which is exactly what we want.
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+}
+
+// Writes the outputs manifest to the given path.
+func writeOutputsManifest(path string, outputs map[string]struct{}) error {
+	manifest := outputsManifest{
+		Version: outputsManifestVersion,
+		Outputs: mapKeys(outputs),
+	}
+	sort.Strings(manifest.Outputs)
+
+	raw, err := json.Marshal(&manifest)
+	if err != nil {
+		return errors.Wrap(err, "Error marshaling outputs manifest")
+	}
+
+	if err := writeFileAtomically(path, raw); err != nil {
+		return errors.Wrap(err, "Error writing outputs manifest")
+	}
+
+	return nil
+}
+
+// Returns the path of an output relative to TargetDir, or false if it's not
+// within TargetDir.
+func relativeOutputPath(targetDir, path string) (string, bool) {
+	absTargetDir, err := filepath.Abs(targetDir)
+	if err != nil {
+		return "", false
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(absTargetDir, absPath)
+	if err != nil || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return rel, true
+}
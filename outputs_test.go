@@ -0,0 +1,180 @@
+package modulir
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestOutputAllowed(t *testing.T) {
+	allowlist := []string{"downloads", "*.pdf"}
+
+	assert.True(t, outputAllowed(allowlist, "downloads"))
+	assert.True(t, outputAllowed(allowlist, filepath.Join("downloads", "a", "file")))
+	assert.True(t, outputAllowed(allowlist, "paper.pdf"))
+
+	assert.False(t, outputAllowed(allowlist, "index.html"))
+	assert.False(t, outputAllowed(allowlist, filepath.Join("articles", "downloads")))
+	assert.False(t, outputAllowed(nil, "index.html"))
+}
+
+func TestOutputsManifestPath(t *testing.T) {
+	// Next to the cache file
+	{
+		path, err := outputsManifestPath(filepath.Join("cache", "modulir.json"), "public")
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join("cache", "modulir.json.outputs.json"), path)
+	}
+
+	// In the user's cache directory, distinct for each target directory
+	{
+		path1, err := outputsManifestPath("", "public")
+		assert.NoError(t, err)
+
+		path2, err := outputsManifestPath("", "dist")
+		assert.NoError(t, err)
+
+		cacheDir, err := os.UserCacheDir()
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(cacheDir, "modulir"), filepath.Dir(path1))
+		assert.NotEqual(t, path1, path2)
+	}
+}
+
+func TestPruneOutputs(t *testing.T) {
+	targetDir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(targetDir)
+
+	cacheDir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	c := NewContext(&Args{
+		CacheFile:             filepath.Join(cacheDir, "cache.json"),
+		Log:                   &Logger{Level: LevelInfo},
+		PruneOutputs:          true,
+		PruneOutputsAllowlist: []string{"kept"},
+		TargetDir:             targetDir,
+	})
+
+	writeOutput := func(rel string) string {
+		path := filepath.Join(targetDir, rel)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte("output"), 0644))
+		c.RecordOutput(path)
+		return path
+	}
+
+	// First build records everything.
+	c.ResetBuild()
+	a := writeOutput("a")
+	b := writeOutput(filepath.Join("dir", "b"))
+	kept := writeOutput("kept")
+	assert.NoError(t, pruneOutputs(c, true))
+
+	// An incremental build that only rewrites one output prunes nothing.
+	c.ResetBuild()
+	c.RecordOutput(a)
+	assert.NoError(t, pruneOutputs(c, false))
+	assert.FileExists(t, b)
+
+	// A dry run reports but doesn't delete.
+	c.PruneOutputsDryRun = true
+	c.ResetBuild()
+	c.RecordOutput(a)
+	assert.NoError(t, pruneOutputs(c, true))
+	assert.FileExists(t, b)
+
+	// A full build prunes everything not recorded except what's allowlisted.
+	c.PruneOutputsDryRun = false
+	c.ResetBuild()
+	c.RecordOutput(a)
+	assert.NoError(t, pruneOutputs(c, true))
+	assert.FileExists(t, a)
+	assert.FileExists(t, kept)
+	assert.NoFileExists(t, b)
+	assert.NoDirExists(t, filepath.Dir(b))
+
+	// The manifest is kept out of TargetDir.
+	outputs, err := readOutputsManifest(c.CacheFile + outputsManifestSuffix)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, outputs)
+
+	files, err := ioutil.ReadDir(targetDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(files))
+}
+
+func TestPruneOutputs_CacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	assert.NoError(t, ioutil.WriteFile(source, []byte("source"), 0644))
+
+	config := &Config{
+		CacheFile:    filepath.Join(dir, "cache.json"),
+		Log:          &Logger{Level: LevelWarn},
+		PruneOutputs: true,
+		SourceDir:    dir,
+		TargetDir:    filepath.Join(dir, "public"),
+	}
+
+	a := filepath.Join(config.TargetDir, "a")
+	b := filepath.Join(config.TargetDir, "b")
+
+	// Builds jobs that declare their outputs, plus one that checks the source
+	// with Changed if checkSource is set.
+	run := func(checkSource bool, outputs ...string) {
+		err := NewBuilder(config, func(c *Context) []error {
+			for _, output := range outputs {
+				output := output
+				c.AddJobWithOptions(filepath.Base(output), func() (bool, error) {
+					return true, ioutil.WriteFile(output, []byte("output"), 0644)
+				}, &JobOptions{Outputs: []string{output}})
+			}
+
+			if checkSource {
+				c.AddJob("source", func() (bool, error) {
+					return c.Changed(source), nil
+				})
+			}
+
+			return c.Wait()
+		}).Run(context.Background())
+		assert.NoError(t, err)
+	}
+
+	run(true, a, b)
+	assert.FileExists(t, b)
+
+	// The cache file is loaded and the source is unchanged, so the job that
+	// checks it skips its work. Orphans can't be told apart from outputs
+	// that weren't recorded, so nothing is pruned.
+	run(true, a)
+	assert.FileExists(t, b)
+
+	// Jobs that are up to date are skipped too, but they still record their
+	// declared outputs, so the orphan is pruned.
+	run(false, a)
+	assert.FileExists(t, a)
+	assert.NoFileExists(t, b)
+}
+
+func TestRelativeOutputPath(t *testing.T) {
+	rel, ok := relativeOutputPath("public", filepath.Join("public", "a", "b"))
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join("a", "b"), rel)
+
+	_, ok = relativeOutputPath("public", "public")
+	assert.False(t, ok)
+
+	_, ok = relativeOutputPath("public", filepath.Join("content", "a"))
+	assert.False(t, ok)
+}
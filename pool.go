@@ -1,12 +1,14 @@
 package modulir
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"runtime/debug"
 	"sort"
+	"strings"
 	"sync"
 	"time"
-
-	"github.com/pkg/errors"
 )
 
 //////////////////////////////////////////////////////////////////////////////
@@ -19,9 +21,61 @@ import (
 //
 //////////////////////////////////////////////////////////////////////////////
 
+// Dependency is something that a job can depend on. It's implemented by *Job
+// (a handle to a job that's been added to the pool) and JobName (the name of
+// a job that has been or will be added to the pool in the same round).
+type Dependency interface {
+	dependency()
+}
+
+// Implements Dependency.
+func (j *Job) dependency() {}
+
+// JobName is a Dependency that refers to a job by name. If more than one job
+// in a round has the same name, it refers to the first one added.
+type JobName string
+
+// Implements Dependency.
+func (n JobName) dependency() {}
+
+// DependencyError is the error assigned to a job that was skipped because
+// one of its upstream dependencies failed.
+type DependencyError struct {
+	// Dependency is the upstream job whose failure caused the skip. When
+	// failures cascade across multiple levels of dependencies, this is the
+	// original failed job rather than the one immediately upstream.
+	Dependency *Job
+}
+
+// Error returns a message describing the failed dependency.
+func (e *DependencyError) Error() string {
+	return fmt.Sprintf("Skipped because dependency '%s' failed: %v",
+		e.Dependency.Name, e.Dependency.Err)
+}
+
 // Job is a wrapper for a piece of work that should be executed by the job
 // pool.
 type Job struct {
+	// Attempts is the number of times that the job's function was called.
+	// It's more than one only if the job failed and was retried according to
+	// its Retry policy.
+	Attempts int
+
+	// Class is the name of the resource class that the job belongs to. The
+	// number of jobs of a class that run at once can be limited with the
+	// pool's ResourceClasses.
+	//
+	// Defaults to no class, which isn't limited.
+	Class string
+
+	// DependsOn is a set of jobs that must finish successfully before this
+	// one is run. If any of them fail, this job is skipped and assigned a
+	// DependencyError.
+	//
+	// Dependencies given by JobName must be added to the pool in the same
+	// round as the dependent job.
+	DependsOn []Dependency
+
 	// Duration is the time it took the job to run. It's set regardless of
 	// whether the job's finished state was executed, not executed, or errored.
 	Duration time.Duration
@@ -35,9 +89,75 @@ type Job struct {
 	// F is the function which makes up the job's workload.
 	F func() (bool, error)
 
+	// FContext is an alternative to F for workloads that can be canceled.
+	// Its context is canceled when the job exceeds its timeout or when the
+	// pool is canceled. If set, it's used instead of F.
+	FContext func(ctx context.Context) (bool, error)
+
+	// Inputs are paths to files that the job reads. If a job declares any
+	// inputs or outputs, the pool only runs it when one of its inputs has
+	// changed, or one of its outputs is missing or older than an input.
+	// Otherwise it's considered up to date and F isn't called.
+	Inputs []string
+
 	// Name is a name for the job which is helpful for informational and
 	// debugging purposes.
 	Name string
+
+	// Outputs are paths to files that the job writes. See Inputs.
+	Outputs []string
+
+	// Priority decides the order in which jobs that are ready to run are
+	// picked up by workers. Jobs with a higher priority run first, and jobs
+	// of equal priority run in the order that they became ready. It's useful
+	// for getting small jobs that affect what's seen during development out
+	// of the way before slow ones.
+	//
+	// Defaults to 0. May be negative.
+	Priority int
+
+	// Reason is a short explanation of why a job that declared inputs or
+	// outputs was or wasn't run. It's set by the pool.
+	Reason string
+
+	// Retry is a policy for retrying the job if it fails.
+	//
+	// Defaults to never retrying.
+	Retry *RetryPolicy
+
+	// Round is the number of the round that the job was added in. It's set
+	// by the pool.
+	Round int
+
+	// Start is when a worker started on the job. It's set by the pool, and
+	// left zero if the job never started, like if one of its dependencies
+	// failed.
+	Start time.Time
+
+	// Timeout is a hard timeout for the job. Once it elapses, the context
+	// given to FContext is canceled, the pool stops waiting on the job, and
+	// the job fails with a JobTimeoutError. Jobs using F can't be
+	// interrupted, so they're left to finish in the background.
+	//
+	// Defaults to the pool's JobTimeout if zero.
+	Timeout time.Duration
+
+	// Worker is the number of the worker that ran the job. It's set by the
+	// pool, and only meaningful if Start is set.
+	Worker int
+
+	// Whether the pool gave up waiting on the job after a hard timeout while
+	// its function kept running. Only accessed by the worker that ran it.
+	abandoned bool
+
+	// Internal dependency bookkeeping. All of these are protected by the
+	// depsMu of the pool that the job was added to.
+	deps            []*Job
+	depsWaiting     int
+	depFailed       *Job
+	dependents      []*Job
+	finished        bool
+	depNamesWaiting int
 }
 
 // Error returns the error message of the error wrapped in the job if this was
@@ -60,6 +180,104 @@ func NewJob(name string, f func() (bool, error)) *Job {
 	return &Job{Name: name, F: f}
 }
 
+// NewJobWithContext initializes and returns a new Job whose function takes a
+// context that's canceled when the job times out or the pool is canceled.
+func NewJobWithContext(name string, f func(ctx context.Context) (bool, error)) *Job {
+	return &Job{Name: name, FContext: f}
+}
+
+// ErrJobCanceled is the error assigned to jobs that never got to run because
+// their pool was canceled.
+var ErrJobCanceled = fmt.Errorf("Job canceled")
+
+// JobTimeoutError is the error assigned to a job that exceeded its hard
+// timeout.
+type JobTimeoutError struct {
+	// Timeout is the timeout that the job exceeded.
+	Timeout time.Duration
+}
+
+// Error returns a message describing the timeout.
+func (e *JobTimeoutError) Error() string {
+	return fmt.Sprintf("Job timed out after %v", e.Timeout)
+}
+
+// JobPanicError is the error assigned to a job that panicked.
+type JobPanicError struct {
+	// Stack is the stack trace of the Goroutine that panicked, captured as
+	// the panic was recovered.
+	Stack []byte
+
+	// Value is the value that the job panicked with.
+	Value interface{}
+}
+
+// Error returns a message describing the panic. It doesn't include the stack
+// trace, which is available separately in Stack.
+func (e *JobPanicError) Error() string {
+	return fmt.Sprintf("Job panicked: %v", e.Value)
+}
+
+// Unwrap returns the value that the job panicked with if it was an error.
+func (e *JobPanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// WorkerStatus is a snapshot of what a worker in a pool is doing. See
+// Pool.WorkerStatuses.
+type WorkerStatus struct {
+	// Job is the name of the job that the worker is running. Empty if it's
+	// not running one.
+	Job string
+
+	// JobStart is when the worker started running Job.
+	JobStart time.Time
+
+	// NumJobsErrored, NumJobsExecuted, and NumJobsFinished are the number of
+	// jobs that the worker saw in the current round that errored, did work,
+	// or finished in any way.
+	NumJobsErrored  int
+	NumJobsExecuted int
+	NumJobsFinished int
+
+	// State is a short description of the worker's state like
+	// "job_executing".
+	State string
+
+	// Worker is the worker's number.
+	Worker int
+}
+
+// RetryPolicy describes how a failed job should be retried. It's useful for
+// jobs that do work prone to transient failure like fetching something over
+// the network.
+//
+// Jobs that time out, panic, or that were canceled are never retried.
+type RetryPolicy struct {
+	// Backoff is how long to wait before the first retry. It doubles after
+	// every subsequent attempt.
+	//
+	// Defaults to retrying immediately.
+	Backoff time.Duration
+
+	// MaxAttempts is the maximum number of times the job will be run,
+	// including its first attempt.
+	//
+	// Defaults to 1, which means no retries.
+	MaxAttempts int
+
+	// MaxBackoff is an upper bound for the time to wait between attempts.
+	//
+	// Defaults to no upper bound.
+	MaxBackoff time.Duration
+
+	// Retryable decides whether a given error should be retried.
+	//
+	// Defaults to retrying all errors.
+	Retryable func(err error) bool
+}
+
 // Pool is a worker group that runs a number of jobs at a configured
 // concurrency.
 type Pool struct {
@@ -78,18 +296,58 @@ type Pool struct {
 	// JobsExecuted is a slice of jobs that were executed on the last run.
 	JobsExecuted []*Job
 
+	// JobsRetried is a slice of jobs that were retried at least once on the
+	// last run, whether they eventually succeeded or not.
+	JobsRetried []*Job
+
+	// JobsTimedOut is a slice of jobs that exceeded their hard timeout on the
+	// last run. They're also included in JobsErrored.
+	JobsTimedOut []*Job
+
+	// JobTimeout is a hard timeout applied to any job that doesn't set its
+	// own. See Job.Timeout.
+	//
+	// Defaults to no timeout.
+	JobTimeout time.Duration
+
+	// ResourceClasses maps the names of resource classes to the maximum
+	// number of jobs of each class that may run at once. It's useful for
+	// keeping jobs that are heavy on a particular resource (like the CPU
+	// or the network) from crowding out everything else. See Job.Class.
+	//
+	// Jobs in a class that's not present aren't limited beyond the pool's
+	// concurrency. A job abandoned after a hard timeout keeps its place in
+	// its class until its function actually returns.
+	ResourceClasses map[string]int
+
+	// Checks whether a job input has changed. Set to Context.Changed by
+	// NewContext for pools created within the package.
+	changed func(path string) bool
+
+	cancel         context.CancelFunc
+	cancelMu       sync.Mutex
 	colorizer      *colorizer
 	concurrency    int
+	ctx            context.Context
+	depsMu         sync.Mutex
 	initialized    bool
-	jobsInternal   chan *Job
+	jobsByName     map[string]*Job
+	jobsOnName     map[string][]*Job
 	jobsErroredMu  sync.Mutex
 	jobsExecutedMu sync.Mutex
+	jobsRetriedMu  sync.Mutex
+	jobsTimedOutMu sync.Mutex
 	jobsFeederDone chan struct{}
 	log            LoggerInterface
+	numJobsFed     int
+	numJobsDone    int
+	progressMu     sync.Mutex
+	queue          *jobQueue
 	roundNum       int
 	roundStarted   bool
 	wg             sync.WaitGroup
 	workerInfos    []workerInfo
+	workerInfosMu  sync.Mutex
 }
 
 // NewPool initializes a new pool with the given jobs and at the given
@@ -102,11 +360,29 @@ func NewPool(log LoggerInterface, concurrency int) *Pool {
 		colorizer:   &colorizer{LogColor: false},
 		concurrency: concurrency,
 		log:         log,
+		queue:       newJobQueue(nil),
 		workerInfos: make([]workerInfo, concurrency),
 	}
+	pool.resetCancel(context.Background())
 	return pool
 }
 
+// Cancel cancels the pool. The contexts of jobs that are running are
+// canceled, and jobs that haven't started yet, including those in future
+// rounds, fail with ErrJobCanceled instead of running. A pool owned by a
+// Context stays canceled until the Context starts its next build.
+func (p *Pool) Cancel() {
+	p.cancelMu.Lock()
+	defer p.cancelMu.Unlock()
+
+	p.cancel()
+}
+
+// Canceled returns whether the pool has been canceled.
+func (p *Pool) Canceled() bool {
+	return p.context().Err() != nil
+}
+
 // JobErrors is a shortcut from extracting all the errors out of JobsErrored,
 // the set of jobs that errored on the last round.
 func (p *Pool) JobErrors() []error {
@@ -138,11 +414,42 @@ func (p *Pool) LogErrorsSlice(errors []error) {
 		// wrong.
 		job, ok := err.(*Job)
 
+		var skipped bool
 		if ok {
-			p.log.Errorf(
-				p.colorizer.Bold(p.colorizer.Red("Job error:")).String()+
-					" %v (job: '%s', time: %v)",
-				job.Err, job.Name, job.Duration.Truncate(100*time.Microsecond))
+			_, skipped = job.Err.(*DependencyError)
+		}
+
+		var timedOut bool
+		if ok {
+			_, timedOut = job.Err.(*JobTimeoutError)
+		}
+
+		var panicErr *JobPanicError
+		if ok {
+			panicErr, _ = job.Err.(*JobPanicError)
+		}
+
+		var fields []interface{}
+		if ok {
+			fields = jobLogFields(job)
+		}
+
+		if skipped {
+			WithFields(p.log, fields...).Errorf(
+				p.colorizer.Bold(p.colorizer.Yellow("Job skipped:")).String()+" %v",
+				job.Err)
+		} else if timedOut {
+			WithFields(p.log, fields...).Errorf(
+				p.colorizer.Bold(p.colorizer.Red("Job timed out:")).String()+" %v",
+				job.Err)
+		} else if panicErr != nil {
+			WithFields(p.log, fields...).Errorf(
+				p.colorizer.Bold(p.colorizer.Red("Job panicked:")).String()+" %v\n%s",
+				panicErr.Value, panicErr.Stack)
+		} else if ok {
+			WithFields(p.log, fields...).Errorf(
+				p.colorizer.Bold(p.colorizer.Red("Job error:")).String()+" %v",
+				job.Err)
 		} else {
 			p.log.Errorf(
 				p.colorizer.Bold(p.colorizer.Red("Build error:")).String()+
@@ -174,10 +481,14 @@ func (p *Pool) LogSlowestSlice(jobs []*Job) {
 			p.log.Infof("Jobs executed (slowest first):")
 		}
 
-		p.log.Infof(
-			p.colorizer.Bold(p.colorizer.Cyan("    %s")).String()+
-				" (time: %v)",
-			job.Name, job.Duration.Truncate(100*time.Microsecond))
+		fields := []interface{}{"duration", job.Duration.Truncate(100 * time.Microsecond)}
+		if job.Reason != "" {
+			fields = append(fields, "reason", job.Reason)
+		}
+
+		WithFields(p.log, fields...).Infof(
+			p.colorizer.Bold(p.colorizer.Cyan("    %s")).String(),
+			job.Name)
 
 		if i >= maxMessages-1 {
 			p.log.Infof("... many jobs executed (limit reached)")
@@ -186,6 +497,33 @@ func (p *Pool) LogSlowestSlice(jobs []*Job) {
 	}
 }
 
+// WorkerStatuses returns a snapshot of what each of the pool's workers is
+// currently doing.
+func (p *Pool) WorkerStatuses() []*WorkerStatus {
+	p.workerInfosMu.Lock()
+	defer p.workerInfosMu.Unlock()
+
+	statuses := make([]*WorkerStatus, len(p.workerInfos))
+	for i, info := range p.workerInfos {
+		status := &WorkerStatus{
+			NumJobsErrored:  info.numJobsErrored,
+			NumJobsExecuted: info.numJobsExecuted,
+			NumJobsFinished: info.numJobsFinished,
+			State:           string(info.state),
+			Worker:          i,
+		}
+
+		if info.activeJob != nil {
+			status.Job = info.activeJob.Name
+			status.JobStart = info.activeJob.Start
+		}
+
+		statuses[i] = status
+	}
+
+	return statuses
+}
+
 // StartRound begins an execution round. Internal statistics and other tracking
 // are all reset.
 func (p *Pool) StartRound(roundNum int) {
@@ -200,13 +538,20 @@ func (p *Pool) StartRound(roundNum int) {
 	p.JobsAll = nil
 	p.JobsErrored = nil
 	p.JobsExecuted = nil
+	p.JobsRetried = nil
+	p.JobsTimedOut = nil
+	p.jobsByName = make(map[string]*Job)
 	p.jobsFeederDone = make(chan struct{}, 1)
-	p.jobsInternal = make(chan *Job, 500)
+	p.jobsOnName = make(map[string][]*Job)
 	p.roundStarted = true
 
+	queueRound := p.queue.reopen(p.ResourceClasses)
+
+	p.workerInfosMu.Lock()
 	for i := range p.workerInfos {
 		p.workerInfos[i].reset()
 	}
+	p.workerInfosMu.Unlock()
 
 	// Job feeder
 	go func() {
@@ -214,21 +559,32 @@ func (p *Pool) StartRound(roundNum int) {
 
 		for job := range p.Jobs {
 			p.wg.Add(1)
-			p.jobsInternal <- job
 			p.JobsAll = append(p.JobsAll, job)
+
+			p.progressMu.Lock()
+			p.numJobsFed++
+			p.progressMu.Unlock()
+
+			p.scheduleJob(job)
 		}
 
 		p.log.Debugf("pool: Job feeder: Finished feeding")
 
+		// Now that every job for the round is known, fail any whose
+		// dependencies can never be satisfied so that Wait doesn't block on
+		// them forever.
+		p.failUnsatisfiableJobs()
+
 		// Runs after Jobs has been closed.
 		close(p.jobsFeederDone)
 	}()
 
-	// Worker Goroutines
+	// Worker Goroutines. They're given the queue's round because they may
+	// still be winding down when the next round reopens it.
 	for i := 0; i < p.concurrency; i++ {
 		workerNum := i
 		go func() {
-			p.workForRound(workerNum)
+			p.workForRound(workerNum, queueRound)
 		}()
 	}
 }
@@ -254,7 +610,7 @@ func (p *Pool) Wait() bool {
 	close(p.Jobs)
 
 	// Now wait for the job feeder to be finished so that we know all jobs have
-	// been enqueued in jobsInternal.
+	// been enqueued in the queue.
 	<-p.jobsFeederDone
 
 	// Prints some debug information to help us in case we run into stalling
@@ -278,7 +634,7 @@ func (p *Pool) Wait() bool {
 
 	// Drops workers out of their run loop. Their Goroutines return.
 	// wait on the run gate.
-	close(p.jobsInternal)
+	p.queue.close()
 
 	// Occasionally useful for debugging.
 	//p.logWaitTimeoutInfo()
@@ -351,6 +707,9 @@ const (
 )
 
 func (p *Pool) logWaitTimeoutInfo() {
+	p.workerInfosMu.Lock()
+	defer p.workerInfosMu.Unlock()
+
 	// We don't have an easy channel to count on for this number, so sum the
 	// numbers across all workers.
 	numJobsFinished := 0
@@ -364,7 +723,7 @@ func (p *Pool) logWaitTimeoutInfo() {
 		numJobsFinished,
 		len(p.JobsErrored),
 		len(p.JobsExecuted),
-		len(p.jobsInternal),
+		p.queue.len(),
 	)
 
 	for i, info := range p.workerInfos {
@@ -378,40 +737,425 @@ func (p *Pool) logWaitTimeoutInfo() {
 	}
 }
 
-// Puts a finished job in the right channel and adds run statistics to the
-// worker's info.
-func (p *Pool) setWorkerJobFinished(workerNum int, job *Job, executed bool, err error) {
-	p.workerInfos[workerNum].numJobsFinished++
+// Adds a dependency on dep to job, or if dep is already finished, notes
+// whether it failed. Must be called with depsMu held.
+func (p *Pool) addDependencyLocked(job, dep *Job) {
+	job.deps = append(job.deps, dep)
+
+	if dep.finished {
+		if dep.Err != nil && job.depFailed == nil {
+			job.depFailed = rootFailure(dep)
+		}
+		return
+	}
+
+	dep.dependents = append(dep.dependents, job)
+	job.depsWaiting++
+}
+
+// Fails any jobs in the round whose dependencies can never be satisfied:
+// those depending on a name that no job in the round has, on a job that was
+// never added to the pool, or on each other in a cycle. Called once all jobs
+// for the round have been fed in.
+func (p *Pool) failUnsatisfiableJobs() {
+	type failure struct {
+		job *Job
+		err error
+	}
+	var failures []failure
+
+	p.depsMu.Lock()
+
+	names := make([]string, 0, len(p.jobsOnName))
+	for name := range p.jobsOnName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, job := range p.jobsOnName[name] {
+			failures = append(failures, failure{job,
+				fmt.Errorf("Unknown job dependency '%s'", name)})
+		}
+	}
+	p.jobsOnName = make(map[string][]*Job)
+
+	inRound := make(map[*Job]struct{}, len(p.JobsAll))
+	for _, job := range p.JobsAll {
+		inRound[job] = struct{}{}
+	}
+
+	for _, job := range p.JobsAll {
+		if job.finished || job.depsWaiting == 0 {
+			continue
+		}
+
+		for _, dep := range job.deps {
+			if _, ok := inRound[dep]; !ok && !dep.finished {
+				failures = append(failures, failure{job,
+					fmt.Errorf("Job dependency '%s' was never added to the pool", dep.Name)})
+				break
+			}
+		}
+	}
+
+	for _, cycle := range findDependencyCycles(p.JobsAll) {
+		names := make([]string, len(cycle)+1)
+		for i, job := range cycle {
+			names[i] = job.Name
+		}
+		names[len(cycle)] = cycle[0].Name
+
+		err := fmt.Errorf("Job dependency cycle: %s", strings.Join(names, " -> "))
+		for _, job := range cycle {
+			failures = append(failures, failure{job, err})
+		}
+	}
+
+	p.depsMu.Unlock()
+
+	for _, f := range failures {
+		p.finishJob(f.job, false, f.err)
+	}
+}
+
+// Returns the running totals of jobs that have been fed into the pool and
+// that have finished, across all rounds. Unlike JobsAll, it's safe to call
+// while a round is running, so it's used to report progress.
+func (p *Pool) jobTotals() (int, int) {
+	p.progressMu.Lock()
+	defer p.progressMu.Unlock()
+
+	return p.numJobsFed, p.numJobsDone
+}
+
+// Marks a job as finished, puts it in the right result slices, and releases
+// or skips any jobs that were waiting on it.
+func (p *Pool) finishJob(job *Job, executed bool, err error) {
+	p.depsMu.Lock()
+
+	// A job can be failed through more than one path (say it's part of a
+	// dependency cycle and one of its other dependencies also failed), but
+	// only the first counts.
+	if job.finished {
+		p.depsMu.Unlock()
+		return
+	}
+
+	job.finished = true
+
+	p.progressMu.Lock()
+	p.numJobsDone++
+	p.progressMu.Unlock()
 
 	if err != nil {
 		job.Err = err
+	}
+
+	if executed {
+		job.Executed = true
+	}
+
+	var ready []*Job
+	var skipped []*Job
+	var skippedErrs []error
+
+	for _, dependent := range job.dependents {
+		if dependent.finished {
+			continue
+		}
+
+		dependent.depsWaiting--
+
+		if err != nil && dependent.depFailed == nil {
+			dependent.depFailed = rootFailure(job)
+		}
 
+		if dependent.depFailed != nil {
+			skipped = append(skipped, dependent)
+			skippedErrs = append(skippedErrs,
+				&DependencyError{Dependency: dependent.depFailed})
+		} else if dependent.depsWaiting == 0 && dependent.depNamesWaiting == 0 {
+			ready = append(ready, dependent)
+		}
+	}
+	job.dependents = nil
+
+	p.depsMu.Unlock()
+
+	if err != nil {
 		p.jobsErroredMu.Lock()
 		p.JobsErrored = append(p.JobsErrored, job)
 		p.jobsErroredMu.Unlock()
+	}
 
-		p.workerInfos[workerNum].numJobsErrored++
+	if job.Attempts > 1 {
+		p.jobsRetriedMu.Lock()
+		p.JobsRetried = append(p.JobsRetried, job)
+		p.jobsRetriedMu.Unlock()
 	}
 
-	if executed {
-		job.Executed = true
+	if _, ok := err.(*JobTimeoutError); ok {
+		p.jobsTimedOutMu.Lock()
+		p.JobsTimedOut = append(p.JobsTimedOut, job)
+		p.jobsTimedOutMu.Unlock()
+	}
 
+	if executed {
 		p.jobsExecutedMu.Lock()
 		p.JobsExecuted = append(p.JobsExecuted, job)
 		p.jobsExecutedMu.Unlock()
+	}
 
-		p.workerInfos[workerNum].numJobsExecuted++
+	for _, dependent := range ready {
+		p.queue.push(dependent)
+	}
+
+	for i, dependent := range skipped {
+		p.finishJob(dependent, false, skippedErrs[i])
 	}
 
 	p.wg.Done()
+}
+
+// Schedules a job that's just been fed into the pool. Jobs without any
+// outstanding dependencies are sent straight to workers while the rest are
+// held until their dependencies finish.
+func (p *Pool) scheduleJob(job *Job) {
+	p.depsMu.Lock()
+
+	// Reset bookkeeping in case the job is being reused from a previous
+	// round.
+	job.Attempts = 0
+	job.Round = p.roundNum
+	job.Start = time.Time{}
+	job.Worker = 0
+	job.deps = nil
+	job.depsWaiting = 0
+	job.depFailed = nil
+	job.depNamesWaiting = 0
+	job.finished = false
+
+	for _, dep := range job.DependsOn {
+		switch d := dep.(type) {
+		case *Job:
+			p.addDependencyLocked(job, d)
+
+		case JobName:
+			if target, ok := p.jobsByName[string(d)]; ok {
+				p.addDependencyLocked(job, target)
+			} else {
+				job.depNamesWaiting++
+				p.jobsOnName[string(d)] = append(p.jobsOnName[string(d)], job)
+			}
+		}
+	}
+
+	// Register the job's name and hook up anything that was waiting on it.
+	if _, ok := p.jobsByName[job.Name]; !ok {
+		p.jobsByName[job.Name] = job
+
+		for _, waiting := range p.jobsOnName[job.Name] {
+			waiting.depNamesWaiting--
+			if !waiting.finished {
+				p.addDependencyLocked(waiting, job)
+			}
+		}
+		delete(p.jobsOnName, job.Name)
+	}
+
+	depFailed := job.depFailed
+	ready := job.depsWaiting == 0 && job.depNamesWaiting == 0
+
+	p.depsMu.Unlock()
+
+	if depFailed != nil {
+		p.finishJob(job, false, &DependencyError{Dependency: depFailed})
+		return
+	}
+
+	if ready {
+		p.queue.push(job)
+	}
+}
+
+// Puts a finished job in the right channel and adds run statistics to the
+// worker's info.
+func (p *Pool) setWorkerJobFinished(workerNum int, job *Job, executed bool, err error) {
+	p.workerInfosMu.Lock()
+	p.workerInfos[workerNum].numJobsFinished++
+
+	if err != nil {
+		p.workerInfos[workerNum].numJobsErrored++
+	}
+
+	if executed {
+		p.workerInfos[workerNum].numJobsExecuted++
+	}
 
 	p.workerInfos[workerNum].activeJob = nil
 	p.workerInfos[workerNum].state = workerStateJobFinished
+	p.workerInfosMu.Unlock()
+
+	p.finishJob(job, executed, err)
 }
 
 func (p *Pool) setWorkerJobExecuting(workerNum int, job *Job) {
+	job.Start = time.Now()
+	job.Worker = workerNum
+
+	p.workerInfosMu.Lock()
 	p.workerInfos[workerNum].activeJob = job
 	p.workerInfos[workerNum].state = workerStateJobExecuting
+	p.workerInfosMu.Unlock()
+}
+
+func (p *Pool) setWorkerState(workerNum int, state workerState) {
+	p.workerInfosMu.Lock()
+	p.workerInfos[workerNum].state = state
+	p.workerInfosMu.Unlock()
+}
+
+// Finds cycles among jobs that are still waiting on dependencies. Must be
+// called with depsMu held.
+func findDependencyCycles(jobs []*Job) [][]*Job {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	var cycles [][]*Job
+	var stack []*Job
+	states := make(map[*Job]int)
+
+	var visit func(job *Job)
+	visit = func(job *Job) {
+		states[job] = visiting
+		stack = append(stack, job)
+
+		for _, dep := range job.deps {
+			if dep.finished {
+				continue
+			}
+
+			switch states[dep] {
+			case unvisited:
+				visit(dep)
+
+			case visiting:
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == dep {
+						cycles = append(cycles, append([]*Job(nil), stack[i:]...))
+						break
+					}
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		states[job] = visited
+	}
+
+	for _, job := range jobs {
+		if !job.finished && job.depsWaiting > 0 && states[job] == unvisited {
+			visit(job)
+		}
+	}
+
+	return cycles
+}
+
+// Decides whether a job that declared inputs or outputs needs to run in the
+// style of Make, returning a short explanation of why or why not. Jobs that
+// declare neither always run.
+func (p *Pool) jobStale(job *Job) (bool, string) {
+	if len(job.Inputs) < 1 && len(job.Outputs) < 1 {
+		return true, ""
+	}
+
+	var reason string
+
+	// Every input goes through the changed check, even after one is found to
+	// have changed, so that they're all recorded and watched.
+	if p.changed != nil {
+		for _, input := range job.Inputs {
+			if p.changed(input) && reason == "" {
+				reason = "input changed: " + input
+			}
+		}
+	}
+
+	if reason != "" {
+		return true, reason
+	}
+
+	var newestInput string
+	var newestInputModTime time.Time
+	for _, input := range job.Inputs {
+		info, err := os.Stat(input)
+		if err != nil {
+			// Let the job run so that it can produce an appropriate error.
+			return true, "input missing: " + input
+		}
+
+		if info.ModTime().After(newestInputModTime) {
+			newestInput = input
+			newestInputModTime = info.ModTime()
+		}
+	}
+
+	for _, output := range job.Outputs {
+		info, err := os.Stat(output)
+		if err != nil {
+			return true, "output missing: " + output
+		}
+
+		if info.ModTime().Before(newestInputModTime) {
+			return true, fmt.Sprintf("output older than input: %s (input: %s)",
+				output, newestInput)
+		}
+	}
+
+	// Without outputs or a way of checking whether inputs changed, there's
+	// nothing to compare against.
+	if len(job.Outputs) < 1 && p.changed == nil {
+		return true, "no outputs declared"
+	}
+
+	return false, "up to date"
+}
+
+// Returns the job whose failure is ultimately responsible for the given job
+// failing. This is the job itself unless it was skipped because of a failed
+// dependency.
+func rootFailure(job *Job) *Job {
+	if job.depFailed != nil {
+		return job.depFailed
+	}
+	return job
+}
+
+// Produces fields describing a job for log messages about it. See
+// WithFields.
+func jobLogFields(job *Job) []interface{} {
+	fields := []interface{}{"job", job.Name}
+
+	// Jobs that never started (like ones whose dependencies failed) weren't
+	// run by any worker.
+	if !job.Start.IsZero() {
+		fields = append(fields, "round", job.Round, "worker", job.Worker)
+	}
+
+	if job.Duration > 0 {
+		fields = append(fields, "duration", job.Duration.Truncate(100*time.Microsecond))
+	}
+
+	if job.Attempts > 1 {
+		fields = append(fields, "attempts", job.Attempts)
+	}
+
+	return fields
 }
 
 // Sorts a slice of jobs with the slowest on top.
@@ -422,16 +1166,23 @@ func sortJobsBySlowest(jobs []*Job) {
 }
 
 // The work loop for a single round within a single worker Goroutine.
-func (p *Pool) workForRound(workerNum int) {
-	for j := range p.jobsInternal {
-		// Required so that we have a stable pointer that we can keep past the
-		// lifetime of the loop. Don't change this.
-		job := j
+func (p *Pool) workForRound(workerNum int, queueRound int) {
+	for {
+		job, ok := p.queue.pop(queueRound)
+		if !ok {
+			break
+		}
 
 		p.workJob(workerNum, job)
+
+		// An abandoned job frees its slot once its function returns
+		// instead (see runJob).
+		if !job.abandoned {
+			p.queue.done(job)
+		}
 	}
 
-	p.workerInfos[workerNum].state = workerStateStopped
+	p.setWorkerState(workerNum, workerStateStopped)
 }
 
 // A worker working a single job. Extracted this way so that we can add a defer
@@ -448,7 +1199,7 @@ func (p *Pool) workJob(workerNum int, job *Job) {
 	go func() {
 		select {
 		case <-time.After(jobSoftTimeout):
-			p.log.Errorf("Job soft timeout (job: '%s')", job.Name)
+			WithFields(p.log, jobLogFields(job)...).Errorf("Job soft timeout")
 		case <-done:
 		}
 	}()
@@ -460,34 +1211,208 @@ func (p *Pool) workJob(workerNum int, job *Job) {
 	defer func() {
 		job.Duration = time.Now().Sub(start)
 
+		if job.Reason != "" {
+			WithFields(p.log, "job", job.Name, "reason", job.Reason).Debugf(
+				"pool: Job executed: %v", executed)
+		}
+
 		// Kill the timeout Goroutine.
 		done <- struct{}{}
 
-		var panicked bool
+		p.setWorkerJobFinished(workerNum, job, executed, jobErr)
+
+		// Leave a trace of the panic in the worker's state for debugging
+		// until it picks up its next job.
+		if _, ok := jobErr.(*JobPanicError); ok {
+			p.setWorkerState(workerNum, workerStatePanicked)
+		}
+	}()
+
+	if p.Canceled() {
+		jobErr = ErrJobCanceled
+		return
+	}
+
+	var stale bool
+	stale, job.Reason = p.jobStale(job)
+	if !stale {
+		return
+	}
+
+	executed, jobErr = p.runJobWithRetries(job)
+}
+
+// Invokes whichever of a job's functions is set. A panic in the function is
+// recovered and returned as a JobPanicError so that the worker lives on to
+// take the next job. Only the job's own code runs under the recover so that
+// a bug in the pool's bookkeeping isn't mistaken for a failed job.
+func callJobFunc(ctx context.Context, job *Job) (executed bool, err error) {
+	defer func() {
+		// The stack has to be captured here because it's gone once the
+		// function returns.
 		if r := recover(); r != nil {
-			if err, ok := r.(error); ok {
-				jobErr = errors.Wrap(err, "Job panicked")
-			} else {
-				// Panics are often just given a string to panic with, so make
-				// sure to handle that as well
-				jobErr = fmt.Errorf("Job panicked: %v", r)
+			executed, err = false, &JobPanicError{Stack: debug.Stack(), Value: r}
+		}
+	}()
+
+	if job.FContext != nil {
+		return job.FContext(ctx)
+	}
+
+	return job.F()
+}
+
+// Creates a new context for the pool derived from parent, uncanceling it if
+// it was canceled. It stays canceled if parent is.
+func (p *Pool) resetCancel(parent context.Context) {
+	p.cancelMu.Lock()
+	defer p.cancelMu.Unlock()
+
+	p.ctx, p.cancel = context.WithCancel(parent)
+}
+
+// Returns the pool's current context, from which all job contexts are
+// derived.
+func (p *Pool) context() context.Context {
+	p.cancelMu.Lock()
+	defer p.cancelMu.Unlock()
+
+	return p.ctx
+}
+
+// Runs a job's function. If the job has a hard timeout, the function runs in
+// a separate Goroutine so that the worker can give up on it once the timeout
+// elapses, even if the function doesn't respect its context's cancellation.
+func (p *Pool) runJob(job *Job) (bool, error) {
+	timeout := job.Timeout
+	if timeout <= 0 {
+		timeout = p.JobTimeout
+	}
+
+	if timeout <= 0 {
+		return callJobFunc(p.context(), job)
+	}
+
+	ctx, cancel := context.WithTimeout(p.context(), timeout)
+	defer cancel()
+
+	type result struct {
+		executed bool
+		err      error
+	}
+
+	// Buffered so that an abandoned job's Goroutine can still send its
+	// result and exit.
+	results := make(chan result, 1)
+
+	go func() {
+		var res result
+		res.executed, res.err = callJobFunc(ctx, job)
+		results <- res
+	}()
+
+	var res result
+	select {
+	case res = <-results:
+
+	case <-ctx.Done():
+		select {
+		case res = <-results:
+			// The job managed to finish right as its context was done.
+
+		default:
+			if ctx.Err() == context.DeadlineExceeded {
+				WithFields(p.log, jobLogFields(job)...).Errorf("Job hard timeout; abandoning it")
+
+				// Hold on to the job's slot in its class until it returns
+				// so that the class's limit still holds.
+				job.abandoned = true
+				go func() {
+					<-results
+					p.queue.done(job)
+				}()
+
+				return false, &JobTimeoutError{Timeout: timeout}
 			}
-			panicked = true
+
+			// The pool was canceled rather than the job timing out, so give
+			// the job a chance to wind down cooperatively.
+			res = <-results
 		}
+	}
 
-		p.setWorkerJobFinished(workerNum, job, executed, jobErr)
+	if _, ok := res.err.(*JobPanicError); ok {
+		return false, res.err
+	}
 
-		// And set the special panicked worker status if we panicked
-		// because it means that this worker is down and no longer
-		// available.
-		//
-		// TODO: It is possible to hit a deadlock if all workers have
-		// panicked and there's still work left to do. The framework should
-		// detect this condition and exit.
-		if panicked {
-			p.workerInfos[workerNum].state = workerStatePanicked
+	if res.err != nil && ctx.Err() == context.DeadlineExceeded {
+		return res.executed, &JobTimeoutError{Timeout: timeout}
+	}
+
+	return res.executed, res.err
+}
+
+// Runs a job, and if it fails, keeps running it according to its retry
+// policy until it either succeeds or runs out of attempts.
+func (p *Pool) runJobWithRetries(job *Job) (bool, error) {
+	for {
+		job.Attempts++
+
+		executed, err := p.runJob(job)
+		if err == nil || !job.Retry.shouldRetry(job.Attempts, err) || p.Canceled() {
+			return executed, err
 		}
-	}()
 
-	executed, jobErr = job.F()
+		backoff := job.Retry.backoff(job.Attempts)
+		WithFields(p.log, "job", job.Name, "attempt", job.Attempts, "max_attempts", job.Retry.MaxAttempts).Warnf(
+			"Job failed; retrying in %v: %v", backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-p.context().Done():
+			return executed, err
+		}
+	}
+}
+
+// Returns how long to wait after the given attempt before making the next
+// one.
+func (r *RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := r.Backoff
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+
+		if r.MaxBackoff > 0 && backoff >= r.MaxBackoff {
+			break
+		}
+	}
+
+	if r.MaxBackoff > 0 && backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+
+	return backoff
+}
+
+// Decides whether a job that failed with the given error on the given attempt
+// should be retried. Safe to call on a nil policy.
+func (r *RetryPolicy) shouldRetry(attempt int, err error) bool {
+	if r == nil || attempt >= r.MaxAttempts {
+		return false
+	}
+
+	switch err.(type) {
+	case *JobPanicError, *JobTimeoutError:
+		return false
+	}
+
+	if err == ErrJobCanceled {
+		return false
+	}
+
+	if r.Retryable != nil {
+		return r.Retryable(err)
+	}
+
+	return true
 }
@@ -1,8 +1,14 @@
 package modulir
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	assert "github.com/stretchr/testify/require"
 )
@@ -96,6 +102,103 @@ func TestWithError(t *testing.T) {
 	assert.Equal(t, fmt.Errorf("error"), j2.Err)
 }
 
+// Every worker panicking, possibly several times over, shouldn't stop the
+// round from finishing.
+func TestWithPanics(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 2)
+
+	p.StartRound(0)
+	for i := 0; i < 4; i++ {
+		p.Jobs <- NewJob("panic job", func() (bool, error) { panic("error") })
+	}
+	j := NewJob("job", func() (bool, error) { return true, nil })
+	p.Jobs <- j
+	p.Wait()
+
+	assert.Equal(t, 5, len(p.JobsAll))
+	assert.Equal(t, 4, len(p.JobsErrored))
+	assert.Equal(t, 1, len(p.JobsExecuted))
+	assert.Equal(t, true, j.Executed)
+}
+
+func TestWithResourceClasses(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 10)
+	p.ResourceClasses = map[string]int{"heavy": 2}
+
+	var running, maxRunning int
+	var mu sync.Mutex
+
+	p.StartRound(0)
+	for i := 0; i < 10; i++ {
+		j := NewJob("heavy job", func() (bool, error) {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+
+			return true, nil
+		})
+		j.Class = "heavy"
+		p.Jobs <- j
+	}
+	p.Wait()
+
+	assert.Equal(t, 10, len(p.JobsExecuted))
+	assert.LessOrEqual(t, maxRunning, 2)
+}
+
+func TestWithResourceClasses_Abandoned(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 2)
+	p.ResourceClasses = map[string]int{"network": 1}
+
+	// A job that's abandoned after its hard timeout, but keeps running.
+	release := make(chan struct{})
+	j0 := NewJob("job 0", func() (bool, error) {
+		<-release
+		return true, nil
+	})
+	j0.Class = "network"
+	j0.Timeout = 10 * time.Millisecond
+
+	p.StartRound(0)
+	p.Jobs <- j0
+	p.Wait()
+
+	assert.Equal(t, 1, len(p.JobsTimedOut))
+
+	// The abandoned job still holds its class's only slot, even in a new
+	// round.
+	started := make(chan struct{})
+	j1 := NewJob("job 1", func() (bool, error) {
+		close(started)
+		return true, nil
+	})
+	j1.Class = "network"
+
+	p.StartRound(1)
+	p.Jobs <- j1
+
+	select {
+	case <-started:
+		assert.Fail(t, "Should not have started a job while its class is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Once the abandoned job's function returns, the next job gets to run.
+	close(release)
+	p.Wait()
+
+	assert.Equal(t, 1, len(p.JobsExecuted))
+}
+
 func TestWorkJob(t *testing.T) {
 	p := NewPool(&Logger{Level: LevelDebug}, 1)
 
@@ -191,8 +294,390 @@ func TestWorkJob_PanicString(t *testing.T) {
 
 	assert.Equal(t, 1, len(p.JobsErrored))
 	assert.Equal(t, 0, len(p.JobsExecuted))
-	assert.Equal(t, []error{fmt.Errorf("Job panicked: error")}, p.JobErrors())
 
+	err := p.JobErrors()[0]
+	assert.Equal(t, "Job panicked: error", err.Error())
+
+	assert.Equal(t, false, j.Executed)
+	assert.Equal(t, "Job panicked: error", j.Err.Error())
+}
+
+func TestWorkJob_PanicStack(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+
+	j := &Job{
+		F: func() (bool, error) {
+			panic("error")
+		},
+		Name: "TestJob",
+	}
+
+	p.wg.Add(1)
+	p.workJob(0, j)
+
+	panicErr, ok := j.Err.(*JobPanicError)
+	assert.True(t, ok)
+	assert.Equal(t, "error", panicErr.Value)
+	assert.Contains(t, string(panicErr.Stack), "TestWorkJob_PanicStack")
+}
+
+func TestWorkJob_PanicWithTimeout(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+
+	j := &Job{
+		F: func() (bool, error) {
+			panic("error")
+		},
+		Name:    "TestJob",
+		Timeout: time.Second,
+	}
+
+	p.wg.Add(1)
+	p.workJob(0, j)
+
+	// The job ran on a separate Goroutine, but its stack is still the one
+	// that's captured.
+	panicErr, ok := j.Err.(*JobPanicError)
+	assert.True(t, ok)
+	assert.Equal(t, "error", panicErr.Value)
+	assert.Contains(t, string(panicErr.Stack), "TestWorkJob_PanicWithTimeout")
+}
+
+func TestWorkJob_Retry(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+
+	var calls int
+	j := &Job{
+		F: func() (bool, error) {
+			calls++
+			if calls < 3 {
+				return false, fmt.Errorf("transient error")
+			}
+			return true, nil
+		},
+		Name:  "TestJob",
+		Retry: &RetryPolicy{MaxAttempts: 5, Backoff: time.Millisecond},
+	}
+
+	p.wg.Add(1)
+	p.workJob(0, j)
+
+	assert.Equal(t, 3, j.Attempts)
+	assert.Equal(t, true, j.Executed)
+	assert.Nil(t, j.Err)
+	assert.Equal(t, []*Job{j}, p.JobsRetried)
+}
+
+func TestWorkJob_RetryExhausted(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+
+	j := &Job{
+		F: func() (bool, error) {
+			return false, fmt.Errorf("error")
+		},
+		Name:  "TestJob",
+		Retry: &RetryPolicy{MaxAttempts: 3},
+	}
+
+	p.wg.Add(1)
+	p.workJob(0, j)
+
+	assert.Equal(t, 3, j.Attempts)
+	assert.Equal(t, fmt.Errorf("error"), j.Err)
+	assert.Equal(t, []*Job{j}, p.JobsErrored)
+	assert.Equal(t, []*Job{j}, p.JobsRetried)
+}
+
+func TestWorkJob_RetryNotRetryable(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+
+	j := &Job{
+		F: func() (bool, error) {
+			return false, fmt.Errorf("permanent error")
+		},
+		Name: "TestJob",
+		Retry: &RetryPolicy{
+			MaxAttempts: 3,
+			Retryable:   func(err error) bool { return err.Error() != "permanent error" },
+		},
+	}
+
+	p.wg.Add(1)
+	p.workJob(0, j)
+
+	assert.Equal(t, 1, j.Attempts)
+	assert.Equal(t, fmt.Errorf("permanent error"), j.Err)
+	assert.Nil(t, p.JobsRetried)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	r := &RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	assert.Equal(t, 1*time.Second, r.backoff(1))
+	assert.Equal(t, 2*time.Second, r.backoff(2))
+	assert.Equal(t, 4*time.Second, r.backoff(3))
+	assert.Equal(t, 5*time.Second, r.backoff(4))
+	assert.Equal(t, 5*time.Second, r.backoff(100))
+
+	r = &RetryPolicy{}
+	assert.Equal(t, time.Duration(0), r.backoff(3))
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	var r *RetryPolicy
+	assert.False(t, r.shouldRetry(1, fmt.Errorf("error")))
+
+	r = &RetryPolicy{MaxAttempts: 2}
+	assert.True(t, r.shouldRetry(1, fmt.Errorf("error")))
+	assert.False(t, r.shouldRetry(2, fmt.Errorf("error")))
+	assert.False(t, r.shouldRetry(1, ErrJobCanceled))
+	assert.False(t, r.shouldRetry(1, &JobPanicError{Value: "error"}))
+	assert.False(t, r.shouldRetry(1, &JobTimeoutError{Timeout: time.Second}))
+}
+
+func TestWithDependencies(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 10)
+
+	p.StartRound(0)
+
+	var order []string
+	var orderMu sync.Mutex
+	record := func(name string) func() (bool, error) {
+		return func() (bool, error) {
+			orderMu.Lock()
+			order = append(order, name)
+			orderMu.Unlock()
+			return true, nil
+		}
+	}
+
+	// Added in reverse order so that only dependency tracking can guarantee
+	// the right execution order.
+	j2 := NewJob("job 2", record("job 2"))
+	j2.DependsOn = []Dependency{JobName("job 1")}
+	p.Jobs <- j2
+	j1 := NewJob("job 1", record("job 1"))
+	j1.DependsOn = []Dependency{JobName("job 0")}
+	p.Jobs <- j1
+	j0 := NewJob("job 0", record("job 0"))
+	p.Jobs <- j0
+	j3 := NewJob("job 3", record("job 3"))
+	j3.DependsOn = []Dependency{j0, j2}
+	p.Jobs <- j3
+	p.Wait()
+
+	assert.Equal(t, 4, len(p.JobsAll))
+	assert.Equal(t, 0, len(p.JobsErrored))
+	assert.Equal(t, 4, len(p.JobsExecuted))
+	assert.Equal(t, []string{"job 0", "job 1", "job 2", "job 3"}, order)
+}
+
+func TestWithDependencies_AcrossRounds(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 10)
+
+	p.StartRound(0)
+	j0 := NewJob("job 0", func() (bool, error) { return true, fmt.Errorf("error") })
+	p.Jobs <- j0
+	p.Wait()
+
+	p.StartRound(1)
+	j1 := NewJob("job 1", func() (bool, error) { return true, nil })
+	j1.DependsOn = []Dependency{j0}
+	p.Jobs <- j1
+	p.Wait()
+
+	assert.Equal(t, 1, len(p.JobsErrored))
+	assert.Equal(t, false, j1.Executed)
+	assert.Equal(t, &DependencyError{Dependency: j0}, j1.Err)
+}
+
+func TestWithDependencies_Cycle(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 10)
+
+	p.StartRound(0)
+	j0 := NewJob("job 0", func() (bool, error) { return true, nil })
+	j0.DependsOn = []Dependency{JobName("job 1")}
+	p.Jobs <- j0
+	j1 := NewJob("job 1", func() (bool, error) { return true, nil })
+	j1.DependsOn = []Dependency{JobName("job 0")}
+	p.Jobs <- j1
+	j2 := NewJob("job 2", func() (bool, error) { return true, nil })
+	p.Jobs <- j2
+	p.Wait()
+
+	assert.Equal(t, 3, len(p.JobsAll))
+	assert.Equal(t, 2, len(p.JobsErrored))
+	assert.Equal(t, 1, len(p.JobsExecuted))
+
+	assert.Equal(t, false, j0.Executed)
+	assert.Contains(t, j0.Err.Error(), "Job dependency cycle: ")
+	assert.Equal(t, false, j1.Executed)
+	assert.Contains(t, j1.Err.Error(), "Job dependency cycle: ")
+	assert.Equal(t, true, j2.Executed)
+}
+
+func TestWithDependencies_Failed(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 10)
+
+	p.StartRound(0)
+	j0 := NewJob("job 0", func() (bool, error) { return true, fmt.Errorf("error") })
+	p.Jobs <- j0
+	j1 := NewJob("job 1", func() (bool, error) { return true, nil })
+	j1.DependsOn = []Dependency{j0}
+	p.Jobs <- j1
+	j2 := NewJob("job 2", func() (bool, error) { return true, nil })
+	j2.DependsOn = []Dependency{JobName("job 1")}
+	p.Jobs <- j2
+	p.Wait()
+
+	assert.Equal(t, 3, len(p.JobsAll))
+	assert.Equal(t, 3, len(p.JobsErrored))
+	assert.Equal(t, 1, len(p.JobsExecuted))
+
+	// Both downstream jobs report the original failure as their cause.
+	assert.Equal(t, false, j1.Executed)
+	assert.Equal(t, &DependencyError{Dependency: j0}, j1.Err)
+	assert.Equal(t, false, j2.Executed)
+	assert.Equal(t, &DependencyError{Dependency: j0}, j2.Err)
+	assert.Equal(t, "Skipped because dependency 'job 0' failed: error", j2.Err.Error())
+}
+
+func TestWithDependencies_Unknown(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 10)
+
+	p.StartRound(0)
+	j0 := NewJob("job 0", func() (bool, error) { return true, nil })
+	j0.DependsOn = []Dependency{JobName("does not exist")}
+	p.Jobs <- j0
+	j1 := NewJob("job 1", func() (bool, error) { return true, nil })
+	j1.DependsOn = []Dependency{NewJob("never added", nil)}
+	p.Jobs <- j1
+	p.Wait()
+
+	assert.Equal(t, 2, len(p.JobsErrored))
+	assert.Equal(t, fmt.Errorf("Unknown job dependency 'does not exist'"), j0.Err)
+	assert.Equal(t, fmt.Errorf("Job dependency 'never added' was never added to the pool"), j1.Err)
+}
+
+func TestWorkJob_InputsOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input")
+	assert.NoError(t, ioutil.WriteFile(input, []byte("input"), 0644))
+
+	output := filepath.Join(dir, "output")
+
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+
+	newJob := func() *Job {
+		j := NewJob("TestJob", func() (bool, error) {
+			return true, ioutil.WriteFile(output, []byte("output"), 0644)
+		})
+		j.Inputs = []string{input}
+		j.Outputs = []string{output}
+		return j
+	}
+
+	// Output missing
+	{
+		j := newJob()
+		p.wg.Add(1)
+		p.workJob(0, j)
+
+		assert.Equal(t, true, j.Executed)
+		assert.Equal(t, "output missing: "+output, j.Reason)
+	}
+
+	// Up to date
+	{
+		j := newJob()
+		p.wg.Add(1)
+		p.workJob(0, j)
+
+		assert.Equal(t, false, j.Executed)
+		assert.Equal(t, "up to date", j.Reason)
+	}
+
+	// Input newer than output
+	{
+		future := time.Now().Add(10 * time.Second)
+		assert.NoError(t, os.Chtimes(input, future, future))
+
+		j := newJob()
+		p.wg.Add(1)
+		p.workJob(0, j)
+
+		assert.Equal(t, true, j.Executed)
+		assert.Equal(t, "output older than input: "+output+" (input: "+input+")", j.Reason)
+	}
+
+	// Input changed according to the changed hook
+	{
+		p.changed = func(path string) bool { return path == input }
+
+		j := newJob()
+		p.wg.Add(1)
+		p.workJob(0, j)
+
+		assert.Equal(t, true, j.Executed)
+		assert.Equal(t, "input changed: "+input, j.Reason)
+	}
+}
+
+func TestWithCancel(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+
+	p.Cancel()
+	assert.True(t, p.Canceled())
+
+	p.StartRound(0)
+	j0 := NewJob("job 0", func() (bool, error) { return true, nil })
+	p.Jobs <- j0
+	p.Wait()
+
+	assert.Equal(t, 1, len(p.JobsErrored))
+	assert.Equal(t, false, j0.Executed)
+	assert.Equal(t, ErrJobCanceled, j0.Err)
+
+	p.resetCancel(context.Background())
+	assert.False(t, p.Canceled())
+}
+
+func TestWorkJob_Timeout(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+
+	j := NewJobWithContext("TestJob", func(ctx context.Context) (bool, error) {
+		<-ctx.Done()
+		return true, ctx.Err()
+	})
+	j.Timeout = 10 * time.Millisecond
+
+	p.wg.Add(1)
+	p.workJob(0, j)
+
+	assert.Equal(t, 1, len(p.JobsErrored))
+	assert.Equal(t, 1, len(p.JobsTimedOut))
+	assert.Equal(t, &JobTimeoutError{Timeout: 10 * time.Millisecond}, j.Err)
+}
+
+func TestWorkJob_TimeoutAbandoned(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+	p.JobTimeout = 10 * time.Millisecond
+
+	// A job that ignores cancellation entirely.
+	release := make(chan struct{})
+	defer close(release)
+	j := NewJob("TestJob", func() (bool, error) {
+		<-release
+		return true, nil
+	})
+
+	p.wg.Add(1)
+	p.workJob(0, j)
+
+	assert.Equal(t, 1, len(p.JobsTimedOut))
 	assert.Equal(t, false, j.Executed)
-	assert.Equal(t, fmt.Errorf("Job panicked: error"), j.Err)
+	assert.Equal(t, "Job timed out after 10ms", j.Err.Error())
 }
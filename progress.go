@@ -0,0 +1,322 @@
+package modulir
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Interval at which the interactive progress display is redrawn.
+const progressRedrawInterval = 200 * time.Millisecond
+
+// Interval between lines of progress when output isn't a terminal.
+const progressLineInterval = 5 * time.Second
+
+// Maximum number of running jobs listed by the interactive progress display.
+const maxProgressRunningJobs = 10
+
+// Reports on the progress of builds while they run. On a terminal, a display
+// of jobs finished and running is redrawn in place below log output.
+// Otherwise, a line summarizing progress is logged every few seconds.
+//
+// For the interactive display to stay below log output, messages have to be
+// sent through the logger returned by wrapLogger.
+type progressReporter struct {
+	// Whether the display is redrawn in place rather than logging lines.
+	interactive bool
+
+	// Logger used for lines of progress when not interactive.
+	log LoggerInterface
+
+	// Where the interactive display is drawn.
+	out io.Writer
+
+	pool *Pool
+
+	// Totals of jobs fed into and finished by the pool when the build
+	// started. Subtracted from its totals to get the build's.
+	baseJobsDone int
+	baseJobsFed  int
+
+	// When the build started.
+	buildStart time.Time
+
+	// Guards everything below, and is held while the display or a log
+	// message is being written so that they don't interleave.
+	mu sync.Mutex
+
+	// Whether a build is being reported on.
+	active bool
+
+	// Lines of the display as of the last redraw, and how many of them are
+	// on screen and need to be erased before anything else is written.
+	lines      []string
+	linesDrawn int
+
+	// Signal the reporting Goroutine to stop and that it has.
+	done chan struct{}
+	stop chan struct{}
+}
+
+// Initializes a new progress reporter that draws to out, which is only done
+// interactively if it's a terminal.
+func newProgressReporter(log LoggerInterface, pool *Pool, out *os.File) *progressReporter {
+	return &progressReporter{
+		interactive: isTerminal(out) && os.Getenv("TERM") != "dumb",
+		log:         log,
+		out:         out,
+		pool:        pool,
+	}
+}
+
+// Starts reporting on a build that started at the given time.
+func (r *progressReporter) start(buildStart time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.active = true
+	r.baseJobsFed, r.baseJobsDone = r.pool.jobTotals()
+	r.buildStart = buildStart
+	r.done = make(chan struct{})
+	r.stop = make(chan struct{})
+
+	interval := progressLineInterval
+	if r.interactive {
+		interval = progressRedrawInterval
+	}
+
+	go r.run(interval, r.stop, r.done)
+}
+
+// Stops reporting on the current build and erases the display. It should be
+// called before the build's results are logged.
+func (r *progressReporter) finish() {
+	r.mu.Lock()
+	if !r.active {
+		r.mu.Unlock()
+		return
+	}
+	stop, done := r.stop, r.done
+	r.mu.Unlock()
+
+	close(stop)
+	<-done
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.erase()
+	r.active = false
+	r.lines = nil
+}
+
+// Wraps a logger so that messages sent through it are written above the
+// interactive display instead of being mixed into it.
+func (r *progressReporter) wrapLogger(log LoggerInterface) LoggerInterface {
+	if !r.interactive {
+		return log
+	}
+
+	return &progressLogger{log: log, reporter: r}
+}
+
+// Erases the interactive display. Must be called with mu held.
+func (r *progressReporter) erase() {
+	if r.linesDrawn < 1 {
+		return
+	}
+
+	// Move the cursor up to the first line of the display and clear
+	// everything from there down.
+	fmt.Fprintf(r.out, "\r\x1b[%dA\x1b[J", r.linesDrawn)
+	r.linesDrawn = 0
+}
+
+// Draws the interactive display as of the last redraw. Must be called with mu
+// held, and after erasing what was on screen. It doesn't take a new snapshot
+// for the same reason that snapshot doesn't hold mu.
+func (r *progressReporter) draw() {
+	for _, line := range r.lines {
+		fmt.Fprintf(r.out, "%s\n", line)
+	}
+	r.linesDrawn = len(r.lines)
+}
+
+// Reports progress on an interval until stop is closed.
+func (r *progressReporter) run(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			snapshot := r.snapshot()
+			if !r.interactive {
+				r.log.Infof("%s", snapshot.summary())
+				continue
+			}
+
+			lines := snapshot.lines(maxProgressRunningJobs)
+
+			r.mu.Lock()
+			r.erase()
+			r.lines = lines
+			r.draw()
+			r.mu.Unlock()
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Takes a snapshot of the build's progress. It's only called from the
+// reporting Goroutine, which is started after the build's baseline is set,
+// so it doesn't need mu. It mustn't hold it either, because the pool logs
+// some messages while holding locks that the snapshot needs.
+func (r *progressReporter) snapshot() *progressSnapshot {
+	fed, done := r.pool.jobTotals()
+
+	snapshot := &progressSnapshot{
+		Elapsed:         time.Now().Sub(r.buildStart),
+		NumJobs:         fed - r.baseJobsFed,
+		NumJobsFinished: done - r.baseJobsDone,
+	}
+
+	for _, status := range r.pool.WorkerStatuses() {
+		if status.Job != "" {
+			snapshot.Running = append(snapshot.Running, status)
+		}
+	}
+
+	// Longest running first because those are the ones holding things up.
+	sort.SliceStable(snapshot.Running, func(i, j int) bool {
+		return snapshot.Running[i].JobStart.Before(snapshot.Running[j].JobStart)
+	})
+
+	return snapshot
+}
+
+// A snapshot of the progress of a build.
+type progressSnapshot struct {
+	// Time since the build started.
+	Elapsed time.Duration
+
+	// Number of jobs that have been added to the build so far, and how many
+	// of them have finished. More jobs may be added by later rounds.
+	NumJobs         int
+	NumJobsFinished int
+
+	// Statuses of workers that are running a job.
+	Running []*WorkerStatus
+}
+
+// Estimates the time remaining until the jobs known so far are finished
+// based on how long the ones that have finished took. Returns zero if
+// there's nothing to go on.
+func (s *progressSnapshot) eta() time.Duration {
+	remaining := s.NumJobs - s.NumJobsFinished
+	if s.NumJobsFinished < 1 || remaining < 1 {
+		return 0
+	}
+
+	return time.Duration(float64(s.Elapsed) / float64(s.NumJobsFinished) * float64(remaining))
+}
+
+// Produces lines for the interactive display, listing up to the given
+// number of running jobs.
+func (s *progressSnapshot) lines(maxRunning int) []string {
+	lines := []string{s.summary()}
+
+	now := time.Now()
+	for i, status := range s.Running {
+		if i >= maxRunning {
+			lines = append(lines, fmt.Sprintf("  ... and %v more", len(s.Running)-maxRunning))
+			break
+		}
+
+		lines = append(lines, fmt.Sprintf("  worker %v: %s (%v)",
+			status.Worker, status.Job, now.Sub(status.JobStart).Truncate(100*time.Millisecond)))
+	}
+
+	return lines
+}
+
+// Summarizes progress on a single line.
+func (s *progressSnapshot) summary() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Building: %v of %v job(s) finished", s.NumJobsFinished, s.NumJobs)
+	if s.NumJobs > 0 {
+		fmt.Fprintf(&b, " (%v%%)", s.NumJobsFinished*100/s.NumJobs)
+	}
+
+	fmt.Fprintf(&b, "; %v running; %v elapsed",
+		len(s.Running), s.Elapsed.Truncate(100*time.Millisecond))
+
+	if eta := s.eta(); eta > 0 {
+		fmt.Fprintf(&b, "; ETA %v", eta.Truncate(100*time.Millisecond))
+	}
+
+	return b.String()
+}
+
+// A logger that keeps messages from being mixed into the interactive
+// progress display by erasing it before each message and redrawing it
+// after.
+type progressLogger struct {
+	log      LoggerInterface
+	reporter *progressReporter
+}
+
+func (l *progressLogger) Debugf(format string, v ...interface{}) {
+	l.around(func() { l.log.Debugf(format, v...) })
+}
+
+func (l *progressLogger) Errorf(format string, v ...interface{}) {
+	l.around(func() { l.log.Errorf(format, v...) })
+}
+
+func (l *progressLogger) Infof(format string, v ...interface{}) {
+	l.around(func() { l.log.Infof(format, v...) })
+}
+
+func (l *progressLogger) Warnf(format string, v ...interface{}) {
+	l.around(func() { l.log.Warnf(format, v...) })
+}
+
+func (l *progressLogger) With(keysAndValues ...interface{}) LoggerInterface {
+	return &progressLogger{log: WithFields(l.log, keysAndValues...), reporter: l.reporter}
+}
+
+func (l *progressLogger) around(fn func()) {
+	r := l.reporter
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.active {
+		fn()
+		return
+	}
+
+	r.erase()
+	fn()
+	r.draw()
+}
@@ -0,0 +1,102 @@
+package modulir
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestProgressReporter(t *testing.T) {
+	var out bytes.Buffer
+
+	pool := NewPool(&Logger{Level: LevelWarn}, 1)
+	reporter := &progressReporter{interactive: true, out: &out, pool: pool}
+	log := reporter.wrapLogger(&writerLogger{&out})
+
+	// Before a build is started, messages are passed straight through.
+	log.Infof("before")
+	assert.Equal(t, "before\n", out.String())
+	out.Reset()
+
+	// Once the display has been drawn, messages are written above it by
+	// erasing and redrawing it, including ones with fields. The display is
+	// drawn by hand rather than with start so that it doesn't change under
+	// the test.
+	reporter.mu.Lock()
+	reporter.active = true
+	reporter.lines = []string{"line 1", "line 2"}
+	reporter.draw()
+	reporter.mu.Unlock()
+
+	WithFields(log, "job", "a").Infof("during")
+	assert.Equal(t, "line 1\nline 2\n\r\x1b[2A\x1b[Jduring (job: 'a')\nline 1\nline 2\n",
+		out.String())
+	out.Reset()
+
+	// Once started and finished, the display is erased for good.
+	reporter.start(time.Now())
+	reporter.finish()
+	assert.Contains(t, out.String(), "\r\x1b[2A\x1b[J")
+	out.Reset()
+
+	log.Infof("after")
+	assert.Equal(t, "after\n", out.String())
+}
+
+func TestProgressSnapshot(t *testing.T) {
+	// Nothing finished yet
+	{
+		snapshot := &progressSnapshot{Elapsed: time.Second, NumJobs: 10}
+		assert.Equal(t, time.Duration(0), snapshot.eta())
+		assert.Equal(t, "Building: 0 of 10 job(s) finished (0%); 0 running; 1s elapsed",
+			snapshot.summary())
+	}
+
+	// Partway through
+	{
+		snapshot := &progressSnapshot{
+			Elapsed:         2 * time.Second,
+			NumJobs:         10,
+			NumJobsFinished: 4,
+			Running: []*WorkerStatus{
+				{Job: "job 1", JobStart: time.Now(), Worker: 0},
+				{Job: "job 2", JobStart: time.Now(), Worker: 1},
+				{Job: "job 3", JobStart: time.Now(), Worker: 2},
+			},
+		}
+		assert.Equal(t, 3*time.Second, snapshot.eta())
+		assert.Equal(t, "Building: 4 of 10 job(s) finished (40%); 3 running; 2s elapsed; ETA 3s",
+			snapshot.summary())
+
+		lines := snapshot.lines(2)
+		assert.Equal(t, 4, len(lines))
+		assert.Equal(t, snapshot.summary(), lines[0])
+		assert.Contains(t, lines[1], "worker 0: job 1")
+		assert.Contains(t, lines[2], "worker 1: job 2")
+		assert.Equal(t, "  ... and 1 more", lines[3])
+	}
+
+	// Everything finished
+	{
+		snapshot := &progressSnapshot{Elapsed: time.Second, NumJobs: 10, NumJobsFinished: 10}
+		assert.Equal(t, time.Duration(0), snapshot.eta())
+	}
+}
+
+// A logger that writes messages and their fields to a writer.
+type writerLogger struct {
+	w io.Writer
+}
+
+func (l *writerLogger) Debugf(format string, v ...interface{}) { l.write(format, v) }
+func (l *writerLogger) Errorf(format string, v ...interface{}) { l.write(format, v) }
+func (l *writerLogger) Infof(format string, v ...interface{})  { l.write(format, v) }
+func (l *writerLogger) Warnf(format string, v ...interface{})  { l.write(format, v) }
+
+func (l *writerLogger) write(format string, v []interface{}) {
+	fmt.Fprintf(l.w, format+"\n", v...)
+}
@@ -0,0 +1,199 @@
+package modulir
+
+import (
+	"container/heap"
+	"sync"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// A queue of jobs that are ready to run. Workers take the job with the
+// highest priority (first in, first out among equals) whose resource class
+// hasn't reached its concurrency limit, blocking when there's nothing they're
+// allowed to run. A pool keeps the same queue across rounds, reopening it for
+// each.
+//
+// It's safe for concurrent use.
+type jobQueue struct {
+	// Maximum number of jobs of each class that may run at once. Classes
+	// that aren't present or have a non-positive limit are only limited by
+	// the number of workers.
+	classLimits map[string]int
+
+	// Number of jobs of each class that were taken from the queue and are
+	// still running. It carries over from one round to the next because a
+	// job abandoned after a hard timeout may still be running.
+	classRunning map[string]int
+
+	// Ready jobs in a separate heap per class so that the best job of each
+	// class can be found quickly.
+	classJobs map[string]*jobHeap
+
+	closed bool
+	cond   *sync.Cond
+	mu     sync.Mutex
+
+	// Round that the queue is open for. Workers of earlier rounds stop
+	// taking jobs once it's been reopened for a later one.
+	round int
+
+	seq  uint64
+	size int
+}
+
+// Initializes a new queue with the given class concurrency limits.
+func newJobQueue(classLimits map[string]int) *jobQueue {
+	q := &jobQueue{
+		classLimits:  classLimits,
+		classRunning: make(map[string]int),
+		classJobs:    make(map[string]*jobHeap),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Closes the queue, causing workers blocked on pop to return. Should only be
+// called once every job has finished.
+func (q *jobQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Signals that a job taken from the queue has finished, freeing up a slot in
+// its class. It may be called after the job's round is over.
+func (q *jobQueue) done(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.classRunning[job.Class]--
+	q.cond.Broadcast()
+}
+
+// Returns the number of jobs waiting in the queue.
+func (q *jobQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.size
+}
+
+// Takes the next job to run in the given round from the queue, blocking until
+// there's one that's allowed to run. Returns false once the queue's been
+// closed or reopened for a later round.
+func (q *jobQueue) pop(round int) (*Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closed || q.round != round {
+			return nil, false
+		}
+
+		var best *jobHeap
+		var bestClass string
+
+		for class, jobs := range q.classJobs {
+			if jobs.Len() < 1 {
+				continue
+			}
+
+			limit := q.classLimits[class]
+			if limit > 0 && q.classRunning[class] >= limit {
+				continue
+			}
+
+			if best == nil || (*jobs)[0].before((*best)[0]) {
+				best = jobs
+				bestClass = class
+			}
+		}
+
+		if best != nil {
+			item := heap.Pop(best).(*queuedJob)
+			q.classRunning[bestClass]++
+			q.size--
+			return item.job, true
+		}
+
+		q.cond.Wait()
+	}
+}
+
+// Adds a job that's ready to run to the queue.
+func (q *jobQueue) push(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs, ok := q.classJobs[job.Class]
+	if !ok {
+		jobs = &jobHeap{}
+		q.classJobs[job.Class] = jobs
+	}
+
+	q.seq++
+	heap.Push(jobs, &queuedJob{job: job, priority: job.Priority, seq: q.seq})
+	q.size++
+
+	q.cond.Signal()
+}
+
+// Reopens the queue for a new round with the given class concurrency limits.
+// Returns the round's number, which workers pass to pop.
+func (q *jobQueue) reopen(classLimits map[string]int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.classLimits = classLimits
+	q.closed = false
+	q.round++
+	return q.round
+}
+
+// A job in a jobQueue along with what's needed to order it.
+type queuedJob struct {
+	job      *Job
+	priority int
+
+	// Order in which the job was pushed so that jobs of equal priority run
+	// in the order that they became ready.
+	seq uint64
+}
+
+// Whether the job should run before another.
+func (j *queuedJob) before(other *queuedJob) bool {
+	if j.priority != other.priority {
+		return j.priority > other.priority
+	}
+	return j.seq < other.seq
+}
+
+// Implements heap.Interface with the job that should run next on top.
+type jobHeap []*queuedJob
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].before(h[j]) }
+func (h jobHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *jobHeap) Push(x interface{}) {
+	*h = append(*h, x.(*queuedJob))
+}
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
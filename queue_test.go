@@ -0,0 +1,78 @@
+package modulir
+
+import (
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestJobQueue(t *testing.T) {
+	q := newJobQueue(nil)
+
+	j0 := &Job{Name: "job 0"}
+	j1 := &Job{Name: "job 1", Priority: 10}
+	j2 := &Job{Name: "job 2"}
+	j3 := &Job{Name: "job 3", Priority: -1}
+	j4 := &Job{Name: "job 4", Priority: 10}
+
+	for _, job := range []*Job{j0, j1, j2, j3, j4} {
+		q.push(job)
+	}
+	assert.Equal(t, 5, q.len())
+
+	// Highest priority first, then in the order jobs were pushed.
+	for _, expected := range []*Job{j1, j4, j0, j2, j3} {
+		job, ok := q.pop(0)
+		assert.True(t, ok)
+		assert.Equal(t, expected, job)
+	}
+	assert.Equal(t, 0, q.len())
+
+	q.close()
+
+	_, ok := q.pop(0)
+	assert.False(t, ok)
+}
+
+func TestJobQueue_ClassLimits(t *testing.T) {
+	q := newJobQueue(map[string]int{"network": 1})
+
+	n0 := &Job{Class: "network", Name: "network 0", Priority: 10}
+	n1 := &Job{Class: "network", Name: "network 1", Priority: 10}
+	j0 := &Job{Name: "job 0"}
+
+	q.push(n0)
+	q.push(n1)
+	q.push(j0)
+
+	job, _ := q.pop(0)
+	assert.Equal(t, n0, job)
+
+	// The network class is full, so a lower priority job of another class
+	// gets to go ahead.
+	job, _ = q.pop(0)
+	assert.Equal(t, j0, job)
+
+	// Nothing else can run until the network job finishes.
+	popped := make(chan *Job)
+	go func() {
+		job, _ := q.pop(0)
+		popped <- job
+	}()
+
+	select {
+	case <-popped:
+		assert.Fail(t, "Should not have popped a job while its class is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.done(n0)
+
+	select {
+	case job := <-popped:
+		assert.Equal(t, n1, job)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Should have popped a job once its class had room")
+	}
+}
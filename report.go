@@ -0,0 +1,192 @@
+package modulir
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Version of the build report format. Bump this whenever the format changes
+// in a way that's incompatible with older versions so that tools consuming
+// reports can tell the difference.
+const buildReportVersion = 1
+
+// A machine-readable report of a single build written to Config.ReportPath.
+// Durations are in milliseconds.
+type buildReport struct {
+	// Version is the version of the report format.
+	Version int `json:"version"`
+
+	// Start is when the build started.
+	Start time.Time `json:"start"`
+
+	// DurationMs is the total time that the build took.
+	DurationMs float64 `json:"duration_ms"`
+
+	// LoopDurationMs is the time spent in the user's build function
+	// enqueuing jobs, excluding time spent waiting on them.
+	LoopDurationMs float64 `json:"loop_duration_ms"`
+
+	// Success is whether the build finished without any errors.
+	Success bool `json:"success"`
+
+	// Errors are the messages of every error produced by the build,
+	// including those of errored jobs.
+	Errors []string `json:"errors"`
+
+	NumJobs         int `json:"num_jobs"`
+	NumJobsErrored  int `json:"num_jobs_errored"`
+	NumJobsExecuted int `json:"num_jobs_executed"`
+	NumJobsRetried  int `json:"num_jobs_retried"`
+	NumJobsTimedOut int `json:"num_jobs_timed_out"`
+	NumRounds       int `json:"num_rounds"`
+
+	// Jobs contains every job in the build in the order that they were
+	// added.
+	Jobs []*buildReportJob `json:"jobs"`
+
+	// Outputs are the paths of the outputs recorded by the build (see
+	// Context.RecordOutput), relative to TargetDir.
+	Outputs []string `json:"outputs"`
+
+	// WrittenOutputs are the subset of Outputs that were actually written by
+	// the build (see Context.RecordWrittenOutput), as opposed to being left
+	// in place because they were up to date.
+	WrittenOutputs []string `json:"written_outputs"`
+
+	// WrittenOutputsComplete is whether WrittenOutputs is known to cover
+	// every file that the build wrote. That's only the case if every job
+	// that did work declared its Job.Outputs, because jobs that didn't may
+	// have written files without recording them.
+	WrittenOutputsComplete bool `json:"written_outputs_complete"`
+}
+
+// A single job within a buildReport.
+type buildReportJob struct {
+	Name  string `json:"name"`
+	Round int    `json:"round"`
+
+	// Worker is the number of the worker that ran the job, and
+	// StartOffsetMs when it started relative to the start of the build.
+	// Both are omitted for jobs that never started, like those whose
+	// dependencies failed.
+	Worker        *int     `json:"worker,omitempty"`
+	StartOffsetMs *float64 `json:"start_offset_ms,omitempty"`
+
+	DurationMs float64 `json:"duration_ms"`
+	Attempts   int     `json:"attempts"`
+	Executed   bool    `json:"executed"`
+	Errored    bool    `json:"errored"`
+	Error      string  `json:"error,omitempty"`
+	Reason     string  `json:"reason,omitempty"`
+}
+
+// Builds a report from the context's stats, the given jobs, and the given
+// errors.
+func newBuildReport(c *Context, jobs []*Job, buildErrors []error,
+	duration time.Duration) *buildReport {
+
+	report := &buildReport{
+		Version:        buildReportVersion,
+		Start:          c.Stats.Start,
+		DurationMs:     durationMs(duration),
+		LoopDurationMs: durationMs(c.Stats.LoopDuration),
+		Errors:         make([]string, len(buildErrors)),
+		NumJobs:        len(jobs),
+		NumRounds:      c.Stats.NumRounds,
+		Jobs:           make([]*buildReportJob, len(jobs)),
+		Outputs:        mapKeys(c.recordedOutputs()),
+		WrittenOutputs: mapKeys(c.writtenOutputs()),
+
+		WrittenOutputsComplete: true,
+	}
+	sort.Strings(report.Outputs)
+	sort.Strings(report.WrittenOutputs)
+
+	for i, err := range buildErrors {
+		report.Errors[i] = err.Error()
+	}
+
+	for i, job := range jobs {
+		reportJob := &buildReportJob{
+			Name:       job.Name,
+			Round:      job.Round,
+			DurationMs: durationMs(job.Duration),
+			Attempts:   job.Attempts,
+			Executed:   job.Executed,
+			Errored:    job.Err != nil,
+			Reason:     job.Reason,
+		}
+
+		if job.Err != nil {
+			reportJob.Error = job.Err.Error()
+			report.NumJobsErrored++
+		}
+
+		if _, ok := job.Err.(*JobTimeoutError); ok {
+			report.NumJobsTimedOut++
+		}
+
+		if job.Executed {
+			report.NumJobsExecuted++
+
+			if len(job.Outputs) < 1 {
+				report.WrittenOutputsComplete = false
+			}
+		}
+
+		if job.Attempts > 1 {
+			report.NumJobsRetried++
+		}
+
+		if !job.Start.IsZero() {
+			worker := job.Worker
+			startOffset := durationMs(job.Start.Sub(c.Stats.Start))
+
+			reportJob.Worker = &worker
+			reportJob.StartOffsetMs = &startOffset
+		}
+
+		report.Jobs[i] = reportJob
+	}
+
+	report.Success = len(buildErrors) < 1 && report.NumJobsErrored < 1
+
+	return report
+}
+
+// Converts a duration to fractional milliseconds.
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Writes a report to the context's configured ReportPath (if any).
+func writeBuildReport(c *Context, report *buildReport) error {
+	if c.ReportPath == "" {
+		return nil
+	}
+
+	raw, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Error marshaling build report")
+	}
+
+	if err := writeFileAtomically(c.ReportPath, raw); err != nil {
+		return errors.Wrap(err, "Error writing build report")
+	}
+
+	c.Log.Debugf("Wrote build report to '%s'", c.ReportPath)
+	return nil
+}
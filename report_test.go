@@ -0,0 +1,71 @@
+package modulir
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestBuildReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	reportPath := filepath.Join(dir, "reports", "build.json")
+
+	c := NewContext(&Args{
+		Log:        &Logger{Level: LevelInfo},
+		Pool:       NewPool(&Logger{Level: LevelInfo}, 2),
+		ReportPath: reportPath,
+	})
+
+	c.StartRound()
+	j0 := c.AddJob("job 0", func() (bool, error) { return true, nil })
+	j1 := c.AddJob("job 1", func() (bool, error) { return false, fmt.Errorf("error") })
+	c.AddJob("job 2", func() (bool, error) { return true, nil }, j1)
+	errors := c.Wait()
+	c.Pool.Wait()
+
+	report := newBuildReport(c, c.Stats.JobsAll, errors, time.Second)
+	assert.NoError(t, writeBuildReport(c, report))
+
+	raw, err := ioutil.ReadFile(reportPath)
+	assert.NoError(t, err)
+
+	var data map[string]interface{}
+	assert.NoError(t, json.Unmarshal(raw, &data))
+
+	assert.Equal(t, float64(buildReportVersion), data["version"])
+	assert.Equal(t, float64(1000), data["duration_ms"])
+	assert.Equal(t, false, data["success"])
+	assert.Equal(t, float64(3), data["num_jobs"])
+	assert.Equal(t, float64(2), data["num_jobs_errored"])
+	assert.Equal(t, float64(1), data["num_jobs_executed"])
+
+	jobs := data["jobs"].([]interface{})
+	assert.Equal(t, 3, len(jobs))
+
+	job0 := jobs[0].(map[string]interface{})
+	assert.Equal(t, j0.Name, job0["name"])
+	assert.Equal(t, true, job0["executed"])
+	assert.Equal(t, false, job0["errored"])
+	assert.Contains(t, job0, "worker")
+	assert.Contains(t, job0, "start_offset_ms")
+
+	job1 := jobs[1].(map[string]interface{})
+	assert.Equal(t, true, job1["errored"])
+	assert.Equal(t, "error", job1["error"])
+
+	// The job was skipped because its dependency failed, so it never got a
+	// worker.
+	job2 := jobs[2].(map[string]interface{})
+	assert.Equal(t, true, job2["errored"])
+	assert.NotContains(t, job2, "worker")
+	assert.NotContains(t, job2, "start_offset_ms")
+}
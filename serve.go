@@ -0,0 +1,532 @@
+package modulir
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Produces a handler that serves the contents of TargetDir. Beyond what
+// http.FileServer does, it emulates the routing of production static hosts
+// as configured: pretty URLs, a custom not found page, a redirects file,
+// content types, and precompressed files.
+func newTargetDirHandler(c *Context) http.Handler {
+	return &targetDirHandler{
+		c:          c,
+		fileServer: http.FileServer(http.Dir(c.TargetDir)),
+	}
+}
+
+// Serves files from TargetDir. See newTargetDirHandler.
+type targetDirHandler struct {
+	c          *Context
+	fileServer http.Handler
+}
+
+func (h *targetDirHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upath := path.Clean("/" + r.URL.Path)
+
+	if h.c.ServeRedirectsFile != "" {
+		rules, err := loadRedirectRules(h.c.ServeRedirectsFile)
+		if err != nil {
+			h.c.Log.Errorf("Error loading redirects file: %v", err)
+		}
+
+		// Like on Netlify, a rule only shadows a file that exists if it's
+		// forced.
+		for _, rule := range rules {
+			target, ok := rule.match(upath)
+			if !ok {
+				continue
+			}
+
+			if rule.Force || !h.exists(upath) {
+				h.serveRule(w, r, rule, target)
+				return
+			}
+
+			break
+		}
+	}
+
+	if info, err := os.Stat(h.filePath(upath)); err == nil {
+		name := h.filePath(upath)
+		if info.IsDir() && strings.HasSuffix(r.URL.Path, "/") {
+			name = filepath.Join(name, "index.html")
+		}
+
+		// Files and index pages are served directly so that they get the
+		// same headers as everything else. The rest, like directory listings
+		// and redirects to add a trailing slash to a directory, are left to
+		// the file server.
+		if info, err := os.Stat(name); err == nil && info.Mode().IsRegular() {
+			h.serveFile(w, r, name, http.StatusOK)
+			return
+		}
+
+		h.fileServer.ServeHTTP(w, r)
+		return
+	}
+
+	if h.c.ServePrettyURLs {
+		if name, ok := h.resolve(upath); ok {
+			h.serveFile(w, r, name, http.StatusOK)
+			return
+		}
+	}
+
+	h.serveNotFound(w, r)
+}
+
+// Whether a file or directory exists in TargetDir at the given URL path.
+func (h *targetDirHandler) exists(upath string) bool {
+	_, err := os.Stat(h.filePath(upath))
+	return err == nil
+}
+
+// Maps a URL path to a path in TargetDir.
+func (h *targetDirHandler) filePath(upath string) string {
+	return filepath.Join(h.c.TargetDir, filepath.FromSlash(path.Clean("/"+upath)))
+}
+
+// Finds the file that should be served for the given URL path the way a
+// production host would, trying an index page for directories and, if
+// ServePrettyURLs is on, an HTML file of the same name.
+func (h *targetDirHandler) resolve(upath string) (string, bool) {
+	name := h.filePath(upath)
+
+	candidates := []string{name, filepath.Join(name, "index.html")}
+	if h.c.ServePrettyURLs && upath != "/" {
+		candidates = append(candidates, name+".html")
+	}
+
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if err == nil && !info.IsDir() {
+			return candidate, true
+		}
+	}
+
+	return "", false
+}
+
+// Serves ServeNotFoundPage with a 404 status if it's configured and exists,
+// and a plain 404 otherwise.
+func (h *targetDirHandler) serveNotFound(w http.ResponseWriter, r *http.Request) {
+	if h.c.ServeNotFoundPage != "" {
+		name := filepath.Join(h.c.TargetDir, h.c.ServeNotFoundPage)
+		if _, err := os.Stat(name); err == nil {
+			h.serveFile(w, r, name, http.StatusNotFound)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+// Applies a matched redirect rule. Rules with a redirect status send the
+// client to the target, and ones with any other status serve the target's
+// contents with that status.
+func (h *targetDirHandler) serveRule(w http.ResponseWriter, r *http.Request,
+	rule *redirectRule, target string) {
+
+	if rule.Status >= 300 && rule.Status < 400 {
+		if r.URL.RawQuery != "" && !strings.Contains(target, "?") {
+			target += "?" + r.URL.RawQuery
+		}
+
+		http.Redirect(w, r, target, rule.Status)
+		return
+	}
+
+	if strings.Contains(target, "://") {
+		h.c.Log.Errorf("Can't serve '%s' from '%s': proxying to other hosts isn't supported",
+			r.URL.Path, target)
+		http.Error(w, "Proxying isn't supported by the development server",
+			http.StatusBadGateway)
+		return
+	}
+
+	// Query strings are meaningless to static files.
+	if i := strings.Index(target, "?"); i != -1 {
+		target = target[:i]
+	}
+
+	name, ok := h.resolve(target)
+	if !ok {
+		h.serveNotFound(w, r)
+		return
+	}
+
+	h.serveFile(w, r, name, rule.Status)
+}
+
+// Serves the file at the given path with the given status. Its content type
+// comes from ServeContentTypes if a pattern matches, and a precompressed
+// sibling is served in its place if ServePrecompressed is on and the client
+// accepts it. Successful responses go through http.ServeContent so that
+// conditional and range requests work.
+func (h *targetDirHandler) serveFile(w http.ResponseWriter, r *http.Request, name string, status int) {
+	header := w.Header()
+	header.Set("Content-Type", h.contentType(name))
+
+	served := name
+	if h.c.ServePrecompressed {
+		variant, encoding, vary := findPrecompressed(name, r.Header.Get("Accept-Encoding"))
+
+		// Responses vary if a compressed variant exists, even if this client
+		// isn't getting it.
+		if vary {
+			header.Add("Vary", "Accept-Encoding")
+		}
+
+		if variant != "" {
+			header.Set("Content-Encoding", encoding)
+			served = variant
+		}
+	}
+
+	f, err := os.Open(served)
+	if err != nil {
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return
+	}
+
+	if status == http.StatusOK {
+		http.ServeContent(w, r, served, info.ModTime(), f)
+		return
+	}
+
+	header.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(status)
+
+	if r.Method != http.MethodHead {
+		io.Copy(w, f)
+	}
+}
+
+// Determines the content type of the file at the given path, from
+// ServeContentTypes if one of its patterns matches, then the file's
+// extension, and finally by sniffing its contents.
+func (h *targetDirHandler) contentType(name string) string {
+	if rel, err := filepath.Rel(h.c.TargetDir, name); err == nil {
+		if contentType, ok := matchContentType(h.c.ServeContentTypes, filepath.ToSlash(rel)); ok {
+			return contentType
+		}
+	}
+
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	return http.DetectContentType(buf[:n])
+}
+
+// Finds the content type for a path relative to TargetDir in a map of
+// patterns to content types. Patterns use path.Match syntax. Ones containing
+// a slash match the whole path and others only its base name, so "*.atom"
+// matches any Atom feed while "articles/*" only matches files directly in
+// "articles". Longer patterns are tried first because they're usually more
+// specific.
+func matchContentType(contentTypes map[string]string, rel string) (string, bool) {
+	if len(contentTypes) < 1 {
+		return "", false
+	}
+
+	patterns := make([]string, 0, len(contentTypes))
+	for pattern := range contentTypes {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	for _, pattern := range patterns {
+		target := rel
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(rel)
+		}
+
+		if ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), target); ok {
+			return contentTypes[pattern], true
+		}
+	}
+
+	return "", false
+}
+
+// Encodings of precompressed files in order of preference, along with the
+// extensions of their files.
+var precompressedEncodings = []struct {
+	encoding  string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// Looks for a precompressed sibling of the file at the given path that's
+// acceptable according to an Accept-Encoding header. Returns the sibling's
+// path and encoding if one is found, along with whether any sibling exists
+// at all.
+func findPrecompressed(name, acceptEncoding string) (string, string, bool) {
+	var variant, encoding string
+	var vary bool
+
+	for _, e := range precompressedEncodings {
+		info, err := os.Stat(name + e.extension)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		vary = true
+
+		if variant == "" && acceptsEncoding(acceptEncoding, e.encoding) {
+			variant = name + e.extension
+			encoding = e.encoding
+		}
+	}
+
+	return variant, encoding, vary
+}
+
+// Whether an Accept-Encoding header allows the given encoding, either by
+// name or through a wildcard, with a non-zero quality.
+func acceptsEncoding(header, encoding string) bool {
+	var accepted bool
+
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != encoding && name != "*" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		// An explicit entry for the encoding takes precedence over a
+		// wildcard.
+		if name == encoding {
+			return quality > 0
+		}
+		accepted = quality > 0
+	}
+
+	return accepted
+}
+
+// A single rule from a redirects file.
+type redirectRule struct {
+	// Force causes the rule to apply even when a file exists at the path
+	// it matches. Set by suffixing the status with "!".
+	Force bool
+
+	// From is the URL path that the rule matches. Segments starting with
+	// a colon are placeholders that match any single segment, and a final
+	// segment of "*" matches everything after it.
+	From string
+
+	// Status is the status of the response. Redirect statuses (3xx) send
+	// the client to To, and anything else serves To's contents as a
+	// rewrite.
+	Status int
+
+	// To is where the rule sends requests. Placeholders from From and
+	// ":splat" are substituted in.
+	To string
+}
+
+// Matches the rule against a URL path, returning the target with any
+// placeholders filled in if it matches.
+func (rule *redirectRule) match(upath string) (string, bool) {
+	fromSegments := splitURLPath(rule.From)
+	pathSegments := splitURLPath(upath)
+
+	params := make(map[string]string)
+
+	for i, segment := range fromSegments {
+		if segment == "*" && i == len(fromSegments)-1 {
+			params["splat"] = strings.Join(pathSegments[i:], "/")
+			return expandRedirectTarget(rule.To, params), true
+		}
+
+		if i >= len(pathSegments) {
+			return "", false
+		}
+
+		if strings.HasPrefix(segment, ":") {
+			params[segment[1:]] = pathSegments[i]
+			continue
+		}
+
+		if segment != pathSegments[i] {
+			return "", false
+		}
+	}
+
+	if len(fromSegments) != len(pathSegments) {
+		return "", false
+	}
+
+	return expandRedirectTarget(rule.To, params), true
+}
+
+// Substitutes matched placeholders into a rule's target.
+func expandRedirectTarget(to string, params map[string]string) string {
+	if len(params) < 1 {
+		return to
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+
+	// Longest first so that a placeholder like ":id" doesn't clobber part of
+	// one like ":identifier".
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+
+	var oldnew []string
+	for _, name := range names {
+		oldnew = append(oldnew, ":"+name, params[name])
+	}
+
+	return strings.NewReplacer(oldnew...).Replace(to)
+}
+
+// Reads the redirect rules in the file at the given path. It's read on every
+// request so that changes to it take effect right away. A file that doesn't
+// exist (yet) has no rules.
+func loadRedirectRules(name string) ([]*redirectRule, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error opening redirects file")
+	}
+	defer f.Close()
+
+	return parseRedirectRules(f)
+}
+
+// Parses redirect rules in the style of Netlify's `_redirects` file. Each
+// line is a rule with a source path, a target, and optionally a status
+// (defaulting to 301) which is forced if suffixed with "!", like:
+//
+//	/old-path      /new-path
+//	/blog/*        /articles/:splat  302
+//	/users/:id     /users/show.html  200
+//	/legacy/*      /404.html         404!
+//
+// Blank lines and ones starting with "#" are ignored.
+func parseRedirectRules(r io.Reader) ([]*redirectRule, error) {
+	var rules []*redirectRule
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Line %v: expected a source path and a target", lineNum)
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("Line %v: unexpected fields after status (conditions aren't supported)", lineNum)
+		}
+
+		if !strings.HasPrefix(fields[0], "/") {
+			return nil, fmt.Errorf("Line %v: source path must start with '/': %s", lineNum, fields[0])
+		}
+
+		rule := &redirectRule{
+			From:   fields[0],
+			Status: http.StatusMovedPermanently,
+			To:     fields[1],
+		}
+
+		if len(fields) == 3 {
+			status := fields[2]
+			if strings.HasSuffix(status, "!") {
+				rule.Force = true
+				status = strings.TrimSuffix(status, "!")
+			}
+
+			var err error
+			rule.Status, err = strconv.Atoi(status)
+			if err != nil || http.StatusText(rule.Status) == "" {
+				return nil, fmt.Errorf("Line %v: invalid status: %s", lineNum, fields[2])
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Error reading redirects file")
+	}
+
+	return rules, nil
+}
+
+// Splits a URL path into its segments, ignoring leading and trailing
+// slashes.
+func splitURLPath(upath string) []string {
+	upath = strings.Trim(upath, "/")
+	if upath == "" {
+		return nil
+	}
+	return strings.Split(upath, "/")
+}
@@ -0,0 +1,294 @@
+package modulir
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestTargetDirHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name, contents string) {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+		assert.NoError(t, ioutil.WriteFile(name, []byte(contents), 0644))
+	}
+
+	writeFile("404.html", "<html><body>Not found</body></html>")
+	writeFile("about.html", "<html><body>About</body></html>")
+	writeFile("app/index.html", "<html><body>App</body></html>")
+	writeFile("blog/index.html", "<html><body>Blog</body></html>")
+	writeFile("kept.html", "<html><body>Kept</body></html>")
+	writeFile("_redirects", strings.Join([]string{
+		"# Comments and blank lines are ignored",
+		"",
+		"/old              /about",
+		"/posts/*          /articles/:splat  302",
+		"/users/:id/:tab   /profiles/:tab/:id",
+		"/app/*            /app/             200",
+		"/kept.html        /about",
+		"/gone/*           /404.html         410!",
+	}, "\n"))
+
+	c := NewContext(&Args{
+		Log:                &Logger{Level: LevelInfo},
+		ServeNotFoundPage:  "404.html",
+		ServePrettyURLs:    true,
+		ServeRedirectsFile: filepath.Join(dir, "_redirects"),
+		TargetDir:          dir,
+	})
+	handler := newTargetDirHandler(c)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder
+	}
+
+	// Pretty URL
+	{
+		recorder := serve("/about")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "<html><body>About</body></html>", recorder.Body.String())
+	}
+
+	// Directory index
+	{
+		recorder := serve("/blog/")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "<html><body>Blog</body></html>", recorder.Body.String())
+	}
+
+	// Custom not found page
+	{
+		recorder := serve("/missing")
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+		assert.Equal(t, "<html><body>Not found</body></html>", recorder.Body.String())
+	}
+
+	// Redirects, including splats, placeholders, and query strings
+	{
+		recorder := serve("/old")
+		assert.Equal(t, http.StatusMovedPermanently, recorder.Code)
+		assert.Equal(t, "/about", recorder.Header().Get("Location"))
+
+		recorder = serve("/posts/2020/hello?ref=feed")
+		assert.Equal(t, http.StatusFound, recorder.Code)
+		assert.Equal(t, "/articles/2020/hello?ref=feed", recorder.Header().Get("Location"))
+
+		recorder = serve("/users/123/settings")
+		assert.Equal(t, http.StatusMovedPermanently, recorder.Code)
+		assert.Equal(t, "/profiles/settings/123", recorder.Header().Get("Location"))
+	}
+
+	// Rewrite
+	{
+		recorder := serve("/app/some/route")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "<html><body>App</body></html>", recorder.Body.String())
+	}
+
+	// An unforced rule doesn't shadow a file that exists, but a forced one
+	// does.
+	{
+		recorder := serve("/kept.html")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "<html><body>Kept</body></html>", recorder.Body.String())
+
+		writeFile("gone/page.html", "<html><body>Gone</body></html>")
+		recorder = serve("/gone/page.html")
+		assert.Equal(t, http.StatusGone, recorder.Code)
+		assert.Equal(t, "<html><body>Not found</body></html>", recorder.Body.String())
+	}
+
+	// The not found page gets live reload so that it refreshes once the page
+	// is built.
+	{
+		recorder := httptest.NewRecorder()
+		injectWebsocketScript(handler).ServeHTTP(recorder, httptest.NewRequest("GET", "/missing", nil))
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), websocketScriptTag)
+	}
+}
+
+func TestTargetDirHandlerDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "about.html"), []byte("About"), 0644))
+
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}, TargetDir: dir})
+	handler := newTargetDirHandler(c)
+
+	// Without any options, it behaves like a plain file server.
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/about", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, "404 page not found\n", recorder.Body.String())
+}
+
+func TestParseRedirectRules(t *testing.T) {
+	rules, err := parseRedirectRules(strings.NewReader(
+		"/a /b\n/c/* /d/:splat 302!\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []*redirectRule{
+		{From: "/a", Status: http.StatusMovedPermanently, To: "/b"},
+		{Force: true, From: "/c/*", Status: http.StatusFound, To: "/d/:splat"},
+	}, rules)
+
+	_, err = parseRedirectRules(strings.NewReader("/a\n"))
+	assert.EqualError(t, err, "Line 1: expected a source path and a target")
+
+	_, err = parseRedirectRules(strings.NewReader("/a /b 999\n"))
+	assert.EqualError(t, err, "Line 1: invalid status: 999")
+
+	_, err = parseRedirectRules(strings.NewReader("a /b\n"))
+	assert.EqualError(t, err, "Line 1: source path must start with '/': a")
+}
+
+func TestRedirectRuleMatch(t *testing.T) {
+	rule := &redirectRule{From: "/blog/*", To: "/articles/:splat"}
+
+	target, ok := rule.match("/blog/2020/hello")
+	assert.True(t, ok)
+	assert.Equal(t, "/articles/2020/hello", target)
+
+	target, ok = rule.match("/blog")
+	assert.True(t, ok)
+	assert.Equal(t, "/articles/", target)
+
+	_, ok = rule.match("/blogs/hello")
+	assert.False(t, ok)
+
+	rule = &redirectRule{From: "/:id/:identifier", To: "/x/:identifier/:id"}
+	target, ok = rule.match("/1/2")
+	assert.True(t, ok)
+	assert.Equal(t, "/x/2/1", target)
+
+	_, ok = rule.match("/1/2/3")
+	assert.False(t, ok)
+}
+
+func TestTargetDirHandlerContentTypesAndPrecompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name, contents string) {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+		assert.NoError(t, ioutil.WriteFile(name, []byte(contents), 0644))
+	}
+
+	writeFile("articles/hello", "<p>Hello</p>")
+	writeFile("feed.atom", "<feed></feed>")
+	writeFile("main.css", "body { color: red; }")
+	writeFile("main.css.br", "brotli")
+	writeFile("main.css.gz", "gzip")
+
+	c := NewContext(&Args{
+		Log: &Logger{Level: LevelInfo},
+		ServeContentTypes: map[string]string{
+			"articles/*": "text/html; charset=utf-8",
+			"*.atom":     "application/atom+xml",
+		},
+		ServePrecompressed: true,
+		TargetDir:          dir,
+	})
+	handler := newTargetDirHandler(c)
+
+	serve := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		handler.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	// Content types from patterns
+	{
+		recorder := serve("/articles/hello", "")
+		assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+
+		recorder = serve("/feed.atom", "")
+		assert.Equal(t, "application/atom+xml", recorder.Header().Get("Content-Type"))
+	}
+
+	// Brotli is preferred.
+	{
+		recorder := serve("/main.css", "gzip, deflate, br")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "br", recorder.Header().Get("Content-Encoding"))
+		assert.Equal(t, "text/css; charset=utf-8", recorder.Header().Get("Content-Type"))
+		assert.Equal(t, "Accept-Encoding", recorder.Header().Get("Vary"))
+		assert.Equal(t, "brotli", recorder.Body.String())
+	}
+
+	// Unless the client doesn't accept it.
+	{
+		recorder := serve("/main.css", "gzip, br;q=0")
+		assert.Equal(t, "gzip", recorder.Header().Get("Content-Encoding"))
+		assert.Equal(t, "gzip", recorder.Body.String())
+	}
+
+	// Clients that don't accept compression get the original.
+	{
+		recorder := serve("/main.css", "")
+		assert.Equal(t, "", recorder.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", recorder.Header().Get("Vary"))
+		assert.Equal(t, "body { color: red; }", recorder.Body.String())
+	}
+
+	// No Vary header for files without compressed variants.
+	{
+		recorder := serve("/feed.atom", "br")
+		assert.Equal(t, "", recorder.Header().Get("Content-Encoding"))
+		assert.Equal(t, "", recorder.Header().Get("Vary"))
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	assert.True(t, acceptsEncoding("gzip, br", "br"))
+	assert.True(t, acceptsEncoding("gzip;q=0.5", "gzip"))
+	assert.True(t, acceptsEncoding("*", "br"))
+	assert.False(t, acceptsEncoding("", "br"))
+	assert.False(t, acceptsEncoding("gzip", "br"))
+	assert.False(t, acceptsEncoding("br;q=0", "br"))
+	assert.False(t, acceptsEncoding("*, br;q=0", "br"))
+}
+
+func TestMatchContentType(t *testing.T) {
+	contentTypes := map[string]string{
+		"*":          "text/plain",
+		"*.atom":     "application/atom+xml",
+		"articles/*": "text/html",
+	}
+
+	contentType, ok := matchContentType(contentTypes, "articles/hello")
+	assert.True(t, ok)
+	assert.Equal(t, "text/html", contentType)
+
+	contentType, ok = matchContentType(contentTypes, "feeds/main.atom")
+	assert.True(t, ok)
+	assert.Equal(t, "application/atom+xml", contentType)
+
+	contentType, ok = matchContentType(contentTypes, "about")
+	assert.True(t, ok)
+	assert.Equal(t, "text/plain", contentType)
+
+	_, ok = matchContentType(nil, "about")
+	assert.False(t, ok)
+}
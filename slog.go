@@ -0,0 +1,78 @@
+//go:build go1.21
+// +build go1.21
+
+package modulir
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Public
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// SlogLogger adapts a logger from `log/slog` so that it can be used as a
+// Modulir logger. Fields are passed through as attributes.
+type SlogLogger struct {
+	// Logger is the logger that messages are sent to.
+	Logger *slog.Logger
+}
+
+// NewSlogLogger initializes and returns a new SlogLogger sending messages to
+// the given logger.
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	return &SlogLogger{Logger: logger}
+}
+
+// Debugf logs a debug message using Printf conventions.
+func (l *SlogLogger) Debugf(format string, v ...interface{}) {
+	l.log(slog.LevelDebug, format, v)
+}
+
+// Errorf logs a warning message using Printf conventions.
+func (l *SlogLogger) Errorf(format string, v ...interface{}) {
+	l.log(slog.LevelError, format, v)
+}
+
+// Infof logs an informational message using Printf conventions.
+func (l *SlogLogger) Infof(format string, v ...interface{}) {
+	l.log(slog.LevelInfo, format, v)
+}
+
+// Warnf logs a warning message using Printf conventions.
+func (l *SlogLogger) Warnf(format string, v ...interface{}) {
+	l.log(slog.LevelWarn, format, v)
+}
+
+// With returns a logger that includes the given fields with every message.
+// See StructuredLoggerInterface.
+func (l *SlogLogger) With(keysAndValues ...interface{}) LoggerInterface {
+	return &SlogLogger{Logger: l.Logger.With(keysAndValues...)}
+}
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+func (l *SlogLogger) log(level slog.Level, format string, v []interface{}) {
+	// Avoid formatting messages that won't be emitted.
+	if !l.Logger.Enabled(context.Background(), level) {
+		return
+	}
+
+	l.Logger.Log(context.Background(), level, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,31 @@
+//go:build go1.21
+// +build go1.21
+
+package modulir
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})))
+
+	logger.Debugf("debug")
+	WithFields(logger, "job", "render", "worker", 3).Warnf("Job %v", "failed")
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+
+	assert.Equal(t, "WARN", entry["level"])
+	assert.Equal(t, "Job failed", entry["msg"])
+	assert.Equal(t, "render", entry["job"])
+	assert.Equal(t, float64(3), entry["worker"])
+}
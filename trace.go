@@ -0,0 +1,182 @@
+package modulir
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// A build timeline in the Chrome Trace Event format, which can be loaded into
+// chrome://tracing or Perfetto. Each worker gets its own track with the jobs
+// that it ran, and the build itself and its rounds are on a separate track.
+//
+// See: https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+type chromeTrace struct {
+	DisplayTimeUnit string              `json:"displayTimeUnit"`
+	TraceEvents     []*chromeTraceEvent `json:"traceEvents"`
+}
+
+// A single event in a chromeTrace. Timestamps and durations are in
+// microseconds.
+type chromeTraceEvent struct {
+	Args     map[string]interface{} `json:"args,omitempty"`
+	Category string                 `json:"cat,omitempty"`
+	Duration int64                  `json:"dur,omitempty"`
+	Name     string                 `json:"name"`
+	Phase    string                 `json:"ph"`
+	PID      int                    `json:"pid"`
+	Scope    string                 `json:"s,omitempty"`
+	TID      int                    `json:"tid"`
+	TS       int64                  `json:"ts"`
+}
+
+// Phases of trace events that are used.
+const (
+	chromeTracePhaseComplete = "X"
+	chromeTracePhaseInstant  = "i"
+	chromeTracePhaseMetadata = "M"
+)
+
+// The track used for build-wide events. Workers get tracks numbered from one
+// after this.
+const chromeTraceBuildTID = 0
+
+// Builds a trace from the context's stats and the given jobs.
+func newChromeTrace(c *Context, jobs []*Job, duration time.Duration) *chromeTrace {
+	trace := &chromeTrace{DisplayTimeUnit: "ms"}
+
+	offset := func(t time.Time) int64 {
+		return t.Sub(c.Stats.Start).Microseconds()
+	}
+
+	addEvent := func(event *chromeTraceEvent) {
+		trace.TraceEvents = append(trace.TraceEvents, event)
+	}
+
+	addEvent(&chromeTraceEvent{
+		Args:  map[string]interface{}{"name": "Modulir"},
+		Name:  "process_name",
+		Phase: chromeTracePhaseMetadata,
+	})
+	addEvent(&chromeTraceEvent{
+		Args:  map[string]interface{}{"name": "Build"},
+		Name:  "thread_name",
+		Phase: chromeTracePhaseMetadata,
+		TID:   chromeTraceBuildTID,
+	})
+
+	addEvent(&chromeTraceEvent{
+		Category: "build",
+		Duration: duration.Microseconds(),
+		Name:     "Build",
+		Phase:    chromeTracePhaseComplete,
+		TID:      chromeTraceBuildTID,
+	})
+
+	for i, start := range c.Stats.RoundStarts {
+		addEvent(&chromeTraceEvent{
+			Category: "round",
+			Name:     fmt.Sprintf("Round %v start", i),
+			Phase:    chromeTracePhaseInstant,
+			Scope:    "g",
+			TID:      chromeTraceBuildTID,
+			TS:       offset(start),
+		})
+	}
+
+	for i, end := range c.Stats.RoundEnds {
+		addEvent(&chromeTraceEvent{
+			Category: "round",
+			Name:     fmt.Sprintf("Round %v end", i),
+			Phase:    chromeTracePhaseInstant,
+			Scope:    "g",
+			TID:      chromeTraceBuildTID,
+			TS:       offset(end),
+		})
+	}
+
+	workers := make(map[int]struct{})
+
+	for _, job := range jobs {
+		// Jobs that never started (like ones whose dependencies failed)
+		// have nothing to show.
+		if job.Start.IsZero() {
+			continue
+		}
+
+		args := map[string]interface{}{
+			"executed": job.Executed,
+			"round":    job.Round,
+		}
+		if job.Attempts > 1 {
+			args["attempts"] = job.Attempts
+		}
+		if job.Err != nil {
+			args["error"] = job.Err.Error()
+		}
+		if job.Reason != "" {
+			args["reason"] = job.Reason
+		}
+
+		addEvent(&chromeTraceEvent{
+			Args:     args,
+			Category: "job",
+			Duration: job.Duration.Microseconds(),
+			Name:     job.Name,
+			Phase:    chromeTracePhaseComplete,
+			TID:      job.Worker + 1,
+			TS:       offset(job.Start),
+		})
+
+		workers[job.Worker] = struct{}{}
+	}
+
+	workerNums := make([]int, 0, len(workers))
+	for worker := range workers {
+		workerNums = append(workerNums, worker)
+	}
+	sort.Ints(workerNums)
+
+	for _, worker := range workerNums {
+		addEvent(&chromeTraceEvent{
+			Args:  map[string]interface{}{"name": fmt.Sprintf("Worker %v", worker)},
+			Name:  "thread_name",
+			Phase: chromeTracePhaseMetadata,
+			TID:   worker + 1,
+		})
+	}
+
+	return trace
+}
+
+// Writes a trace to the context's configured TracePath (if any).
+func writeChromeTrace(c *Context, trace *chromeTrace) error {
+	if c.TracePath == "" {
+		return nil
+	}
+
+	raw, err := json.Marshal(trace)
+	if err != nil {
+		return errors.Wrap(err, "Error marshaling trace")
+	}
+
+	if err := writeFileAtomically(c.TracePath, raw); err != nil {
+		return errors.Wrap(err, "Error writing trace")
+	}
+
+	c.Log.Debugf("Wrote trace to '%s'", c.TracePath)
+	return nil
+}
@@ -0,0 +1,63 @@
+package modulir
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestChromeTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modulir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tracePath := filepath.Join(dir, "trace.json")
+
+	c := NewContext(&Args{
+		Log:       &Logger{Level: LevelInfo},
+		Pool:      NewPool(&Logger{Level: LevelInfo}, 2),
+		TracePath: tracePath,
+	})
+
+	c.StartRound()
+	c.AddJob("job 0", func() (bool, error) { return true, nil })
+	j1 := c.AddJob("job 1", func() (bool, error) { return false, fmt.Errorf("error") })
+	c.AddJob("job 2", func() (bool, error) { return true, nil }, j1)
+	c.Wait()
+	c.Pool.Wait()
+
+	trace := newChromeTrace(c, c.Stats.JobsAll, time.Second)
+	assert.NoError(t, writeChromeTrace(c, trace))
+
+	raw, err := ioutil.ReadFile(tracePath)
+	assert.NoError(t, err)
+
+	var data chromeTrace
+	assert.NoError(t, json.Unmarshal(raw, &data))
+
+	var jobNames, markerNames []string
+	for _, event := range data.TraceEvents {
+		switch event.Category {
+		case "job":
+			assert.Equal(t, chromeTracePhaseComplete, event.Phase)
+			assert.NotEqual(t, chromeTraceBuildTID, event.TID)
+			jobNames = append(jobNames, event.Name)
+
+		case "round":
+			assert.Equal(t, chromeTracePhaseInstant, event.Phase)
+			markerNames = append(markerNames, event.Name)
+		}
+	}
+
+	// The job that was skipped never ran, so it's not in the trace.
+	assert.ElementsMatch(t, []string{"job 0", "job 1"}, jobNames)
+
+	// Two rounds were started (the second by Wait), but only one finished.
+	assert.Equal(t, []string{"Round 0 start", "Round 1 start", "Round 0 end"}, markerNames)
+}
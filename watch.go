@@ -1,6 +1,7 @@
 package modulir
 
 import (
+	"context"
 	"path/filepath"
 	"strings"
 	"time"
@@ -24,8 +25,13 @@ import (
 // It doesn't start listening to fsnotify again until the main loop has
 // signaled rebuildDone, so there is a possibility that in the case of very
 // fast consecutive changes the build might not be perfectly up to date.
-func watchChanges(c *Context, watchEvents chan fsnotify.Event, watchErrors chan error,
-	rebuild chan map[string]struct{}, rebuildDone chan struct{}) {
+//
+// Each rebuild is requested with a context derived from ctx that the watcher
+// cancels to abort it (see AbortOnChange).
+//
+// It stops when the watcher's channels are closed or when stop is closed.
+func watchChanges(ctx context.Context, c *Context, watchEvents chan fsnotify.Event, watchErrors chan error,
+	rebuild chan *rebuildRequest, rebuildDone chan struct{}, stop chan struct{}) {
 
 	var changedSources, lastChangedSources map[string]struct{}
 	var lastRebuild time.Time
@@ -42,10 +48,26 @@ func watchChanges(c *Context, watchEvents chan fsnotify.Event, watchErrors chan
 			lastChangedSources = changedSources
 			changedSources = map[string]struct{}{event.Name: {}}
 
-			if !shouldRebuild(event.Name, event.Op) {
+			c.updateWatched(event)
+
+			if !shouldRebuild(event.Name, event.Op) || c.watchTreeExcludes(event.Name) {
 				continue
 			}
 
+			c.status.recordChange(event)
+
+			// A build that the watcher didn't start, like the initial build or
+			// a forced rebuild from the dashboard, may be in progress. With
+			// AbortOnChange, it's aborted the same way as one that the watcher
+			// started (see below), and the send on rebuild that follows waits
+			// for it to wind down.
+			var aborted bool
+			if c.AbortOnChange && c.status.abortBuild() {
+				c.Log.Infof("Detected change on %v during build; aborting",
+					event.Name)
+				aborted = true
+			}
+
 			// The central purpose of this loop is to make sure we do as few
 			// build loops given incoming changes as possible.
 			//
@@ -63,6 +85,11 @@ func watchChanges(c *Context, watchEvents chan fsnotify.Event, watchErrors chan
 			//
 			// The overwhelmingly common case will be few files being changed,
 			// and therefore the inner for almost never needs to loop.
+			//
+			// With AbortOnChange, the first change to come in during a build
+			// aborts it instead, and the next loop starts as soon as it's
+			// wound down.
+
 			for {
 				if len(changedSources) < 1 {
 					break
@@ -79,17 +106,29 @@ func watchChanges(c *Context, watchEvents chan fsnotify.Event, watchErrors chan
 				// quick that the build can't finish before the next one comes
 				// in. The faster the build, the more often this is a problem.
 				//
-				// I'm not sure why this occurs, but protect against it.
-				if buildWithinSameFileQuiesce(lastRebuild, time.Now(), changedSources, lastChangedSources) {
+				// I'm not sure why this occurs, but protect against it. The
+				// exception is if the last build was aborted, in which case
+				// the changes were never fully built.
+				if !aborted && buildWithinSameFileQuiesce(lastRebuild, time.Now(), changedSources, lastChangedSources) {
 					c.Log.Infof("Identical file(s) %v changed within quiesce time; not rebuilding",
 						mapKeys(changedSources))
 					break
 				}
 
+				aborted = false
 				lastRebuild = time.Now()
 
-				// Start rebuild
-				rebuild <- changedSources
+				// Start rebuild. Its context is created here rather than by
+				// the build loop so that it can be aborted as soon as it's
+				// been requested, even if it hasn't started yet.
+				buildCtx, cancelBuild := context.WithCancel(ctx)
+				select {
+				case rebuild <- &rebuildRequest{ctx: buildCtx, sources: changedSources}:
+				case <-stop:
+					cancelBuild()
+					c.Log.Infof("Watcher detected build loop stopped; stopping")
+					return
+				}
 
 				// Zero out the set of changes and start accumulating.
 				//
@@ -106,26 +145,45 @@ func watchChanges(c *Context, watchEvents chan fsnotify.Event, watchErrors chan
 					select {
 					case <-rebuildDone:
 						// Break and start next outer loop
+						cancelBuild()
 						break INNER_LOOP
 
+					case <-stop:
+						cancelBuild()
+						c.Log.Infof("Watcher detected build loop stopped; stopping")
+						return
+
 					case event, ok := <-watchEvents:
 						if !ok {
+							cancelBuild()
 							c.Log.Infof("Watcher detected closed channel; stopping")
 							return
 						}
 
-						if !shouldRebuild(event.Name, event.Op) {
+						c.updateWatched(event)
+
+						if !shouldRebuild(event.Name, event.Op) || c.watchTreeExcludes(event.Name) {
 							continue
 						}
 
+						c.status.recordChange(event)
+
 						if changedSources == nil {
 							changedSources = make(map[string]struct{})
 						}
 
 						changedSources[event.Name] = struct{}{}
 
+						if c.AbortOnChange && !aborted {
+							c.Log.Infof("Detected change on %v during build; aborting",
+								event.Name)
+							cancelBuild()
+							aborted = true
+						}
+
 					case err, ok := <-watchErrors:
 						if !ok {
+							cancelBuild()
 							c.Log.Infof("Watcher detected closed channel; stopping")
 							return
 						}
@@ -154,6 +212,16 @@ func watchChanges(c *Context, watchEvents chan fsnotify.Event, watchErrors chan
 //
 //////////////////////////////////////////////////////////////////////////////
 
+// A request from the watcher to the build loop for a rebuild.
+type rebuildRequest struct {
+	// Context that the build's context is derived from. The watcher cancels
+	// it to abort the build.
+	ctx context.Context
+
+	// Paths that changed.
+	sources map[string]struct{}
+}
+
 // The time window in which *not* to trigger a rebuild if the next set of
 // detected changes are on exactly the same files as the last.
 const sameFileQuiesceTime = 100 * time.Millisecond
@@ -1,6 +1,7 @@
 package modulir
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -85,11 +86,13 @@ func TestShouldRebuild(t *testing.T) {
 func TestWatchChanges(t *testing.T) {
 	watchEvents := make(chan fsnotify.Event, 1)
 	watchErrors := make(chan error, 1)
-	rebuild := make(chan map[string]struct{}, 1)
+	rebuild := make(chan *rebuildRequest, 1)
 	rebuildDone := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
 
-	go watchChanges(newContext(), watchEvents, watchErrors,
-		rebuild, rebuildDone)
+	go watchChanges(context.Background(), newContext(), watchEvents, watchErrors,
+		rebuild, rebuildDone, stop)
 
 	{
 		// An ineligible even that will be ignored.
@@ -107,8 +110,8 @@ func TestWatchChanges(t *testing.T) {
 		watchEvents <- fsnotify.Event{Name: "a/path", Op: fsnotify.Create}
 
 		select {
-		case sources := <-rebuild:
-			assert.Equal(t, map[string]struct{}{"a/path": {}}, sources)
+		case request := <-rebuild:
+			assert.Equal(t, map[string]struct{}{"a/path": {}}, request.sources)
 		case <-time.After(50 * time.Millisecond):
 			assert.Fail(t, "Should have received a rebuild signal")
 		}
@@ -124,11 +127,11 @@ func TestWatchChanges(t *testing.T) {
 
 		// Now verify that we got the accumulated changes.
 		select {
-		case sources := <-rebuild:
+		case request := <-rebuild:
 			assert.Equal(t, map[string]struct{}{
 				"a/path1": {},
 				"a/path2": {},
-			}, sources)
+			}, request.sources)
 		case <-time.After(50 * time.Millisecond):
 			assert.Fail(t, "Should have received a rebuild signal")
 		}
@@ -141,6 +144,97 @@ func TestWatchChanges(t *testing.T) {
 	close(watchEvents)
 }
 
+func TestWatchChanges_AbortOnChange(t *testing.T) {
+	watchEvents := make(chan fsnotify.Event, 1)
+	watchErrors := make(chan error, 1)
+	rebuild := make(chan *rebuildRequest, 1)
+	rebuildDone := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	c := NewContext(&Args{
+		AbortOnChange: true,
+		Log:           &Logger{Level: LevelInfo},
+	})
+
+	go watchChanges(context.Background(), c, watchEvents, watchErrors, rebuild, rebuildDone, stop)
+
+	watchEvents <- fsnotify.Event{Name: "a/path", Op: fsnotify.Create}
+
+	var request *rebuildRequest
+	select {
+	case request = <-rebuild:
+	case <-time.After(50 * time.Millisecond):
+		assert.FailNow(t, "Should have received a rebuild signal")
+	}
+
+	// A change on the same file while building aborts the build. It's
+	// aborted through the context of its request, so it doesn't matter
+	// whether the build loop has started it yet.
+	watchEvents <- fsnotify.Event{Name: "a/path", Op: fsnotify.Write}
+
+	assert.Eventually(t, func() bool { return request.ctx.Err() != nil },
+		time.Second, time.Millisecond)
+
+	// Signal that the aborted build is finished.
+	rebuildDone <- struct{}{}
+
+	// Even though the change is on the same file and within the quiesce
+	// time, the build was aborted, so expect another rebuild.
+	select {
+	case request = <-rebuild:
+		assert.Equal(t, map[string]struct{}{"a/path": {}}, request.sources)
+		assert.NoError(t, request.ctx.Err())
+	case <-time.After(50 * time.Millisecond):
+		assert.Fail(t, "Should have received a rebuild signal")
+	}
+
+	rebuildDone <- struct{}{}
+
+	close(watchEvents)
+}
+
+func TestWatchChanges_AbortOnChangeInitialBuild(t *testing.T) {
+	watchEvents := make(chan fsnotify.Event, 1)
+	watchErrors := make(chan error, 1)
+	rebuild := make(chan *rebuildRequest, 1)
+	rebuildDone := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	c := NewContext(&Args{
+		AbortOnChange: true,
+		Log:           &Logger{Level: LevelInfo},
+	})
+
+	// The initial build is started by the build loop rather than the
+	// watcher.
+	buildCtx, cancelBuild := context.WithCancel(context.Background())
+	defer cancelBuild()
+	c.status.startBuild(time.Now(), cancelBuild)
+
+	go watchChanges(context.Background(), c, watchEvents, watchErrors, rebuild, rebuildDone, stop)
+
+	watchEvents <- fsnotify.Event{Name: "a/path", Op: fsnotify.Write}
+
+	assert.Eventually(t, func() bool { return buildCtx.Err() != nil },
+		time.Second, time.Millisecond)
+
+	// Once the aborted build winds down, the change is rebuilt.
+	c.status.finishBuild(nil)
+
+	select {
+	case request := <-rebuild:
+		assert.Equal(t, map[string]struct{}{"a/path": {}}, request.sources)
+	case <-time.After(50 * time.Millisecond):
+		assert.Fail(t, "Should have received a rebuild signal")
+	}
+
+	rebuildDone <- struct{}{}
+
+	close(watchEvents)
+}
+
 // Helper to easily create a new Modulir context.
 func newContext() *Context {
 	return NewContext(&Args{Log: &Logger{Level: LevelInfo}})